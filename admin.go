@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleDBStats exposes connection pool statistics for capacity planning.
+func (s *server) handleDBStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.db.Stats()
+
+	writeJSON(w, r, struct {
+		MaxOpenConnections int   `json:"max_open_connections"`
+		OpenConnections    int   `json:"open_connections"`
+		InUse              int   `json:"in_use"`
+		Idle               int   `json:"idle"`
+		WaitCount          int64 `json:"wait_count"`
+		WaitDurationMs     int64 `json:"wait_duration_ms"`
+	}{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+	})
+}
+
+// handleReadOnly reports the read-only mode and, on POST, switches it.
+func (s *server) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			httpError(w, r, "Invalid request. enabled must be true or false.", http.StatusBadRequest)
+			return
+		}
+		s.readOnly.Store(enabled)
+	}
+
+	writeJSON(w, r, struct {
+		ReadOnly bool `json:"read_only"`
+	}{s.readOnly.Load()})
+}
+
+// handleHealthz reports whether the database is reachable, along with the
+// read-only mode so load balancers and clients can route writes elsewhere.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	status, database, code := "ok", "ok", http.StatusOK
+	if err := s.db.PingContext(ctx); err != nil {
+		status, database, code = "unavailable", "unreachable", http.StatusServiceUnavailable
+	}
+
+	writeJSONStatus(w, r, code, struct {
+		Status   string `json:"status"`
+		Database string `json:"database"`
+		ReadOnly bool   `json:"read_only"`
+	}{status, database, s.readOnly.Load()})
+}
+
+// handleReadyz is /healthz for live dashboards: beyond the database being
+// reachable, the newest Weather observation must fall within
+// DATA_FRESHNESS_HOURS, unless that is zero, as a database that stopped
+// receiving data is of no use to them either. An observation counts from the
+// end of its day, station time, sub-daily ones included; a newest Tanggal
+// that is not a date at all fails the check as invalid_date.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	result := struct {
+		Status            string   `json:"status"`
+		Database          string   `json:"database"`
+		LatestObservation *string  `json:"latest_observation"`
+		AgeHours          *float64 `json:"age_hours"`
+		FreshnessHours    float64  `json:"freshness_hours"`
+	}{Status: "ok", Database: "ok", FreshnessHours: config.DataFreshness.Hours()}
+
+	// The newest day is looked up per station, so that each lookup walks the
+	// (station_number, "Tanggal") index instead of the whole table
+	var latest sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT MAX(latest) FROM (SELECT (SELECT MAX(\"Tanggal\") FROM \"Weather\" w WHERE w.station_number = s.station_number) AS latest FROM \"Station\" s) stations").
+		Scan(&latest)
+	if err != nil {
+		log.Println(err)
+		result.Status, result.Database = "unavailable", "unreachable"
+		writeJSONStatus(w, r, http.StatusServiceUnavailable, result)
+		return
+	}
+
+	code := http.StatusOK
+	if !latest.Valid {
+		result.Status, code = "no_data", http.StatusServiceUnavailable
+		writeJSONStatus(w, r, code, result)
+		return
+	}
+	result.LatestObservation = &latest.String
+
+	// Sub-daily rows carry a time after the date, "2023-01-01 13:00"
+	date := latest.String
+	if len(date) > 10 {
+		date = date[:10]
+	}
+	if day, err := time.ParseInLocation("2006-01-02", date, stationTZ); err != nil {
+		result.Status, code = "invalid_date", http.StatusServiceUnavailable
+	} else {
+		age := time.Since(day.AddDate(0, 0, 1))
+		hours := math.Round(math.Max(0, age.Hours())*10) / 10
+		result.AgeHours = &hours
+		if config.DataFreshness > 0 && age > config.DataFreshness {
+			result.Status, code = "stale", http.StatusServiceUnavailable
+		}
+	}
+	writeJSONStatus(w, r, code, result)
+}
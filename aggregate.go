@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseInterval validates an aggregation interval, defaulting to month.
+func parseInterval(interval string) (string, error) {
+	switch interval {
+	case "":
+		return "month", nil
+	case "day", "month", "year":
+		return interval, nil
+	}
+	return "", errors.New("interval must be one of day, month or year.")
+}
+
+// intervalKey returns the bucket a YYYY-MM-DD date falls into.
+func intervalKey(date, interval string) string {
+	switch interval {
+	case "day":
+		return date
+	case "year":
+		return date[:4]
+	}
+	return date[:7]
+}
+
+// monthMinCoverage is the fraction of days in a month that need a reading
+// for its total or mean to count; sparser months are treated as missing.
+// SPI, SPEI, the climate normals and the year-month pivot all share it.
+const monthMinCoverage = 0.8
+
+// dataCoverage tells how much data an aggregate rests on: N days with a
+// reading out of the days expected, as a fraction in Completeness. Clients
+// can use it to flag e.g. a monthly mean computed from only 5 days.
+type dataCoverage struct {
+	N            int     `json:"n"`
+	Completeness float64 `json:"completeness"`
+}
+
+func newDataCoverage(n, expected int) dataCoverage {
+	c := dataCoverage{N: n}
+	if expected > 0 {
+		c.Completeness = float64(n) / float64(expected)
+	}
+	return c
+}
+
+// periodDays returns the number of days of the period named by an
+// intervalKey that fall within start and end inclusive.
+func periodDays(key, interval string, start, end time.Time) int {
+	var first, last time.Time
+	switch interval {
+	case "day":
+		first, _ = time.ParseInLocation("2006-01-02", key, stationTZ)
+		last = first
+	case "year":
+		first, _ = time.ParseInLocation("2006", key, stationTZ)
+		last = first.AddDate(1, 0, -1)
+	default:
+		first, _ = time.ParseInLocation("2006-01", key, stationTZ)
+		last = first.AddDate(0, 1, -1)
+	}
+	if first.Before(start) {
+		first = start
+	}
+	if last.After(end) {
+		last = end
+	}
+	return daysBetween(first, last)
+}
+
+// daysBetween counts the calendar days from first to last inclusive, zero
+// when last comes before first.
+func daysBetween(first, last time.Time) int {
+	if last.Before(first) {
+		return 0
+	}
+	return int(last.Sub(first).Hours()/24+0.5) + 1
+}
+
+// dayLength returns the astronomical day length in hours for a latitude in
+// degrees on the given day, per FAO-56 equations 24, 25 and 34.
+func dayLength(latitude float64, day time.Time) float64 {
+	phi := latitude * math.Pi / 180
+	declination := 0.409 * math.Sin(2*math.Pi/365*float64(day.YearDay())-1.39)
+	x := -math.Tan(phi) * math.Tan(declination)
+	// Polar day and night clamp the sunset hour angle
+	x = math.Max(-1, math.Min(1, x))
+	return 24 / math.Pi * math.Acos(x)
+}
+
+// handleSunshine totals sunshine hours per interval and, against the possible
+// sunshine for the same days, the percentage of possible sunshine received.
+// Possible sunshine is a client-supplied possibleHours per day, or else the
+// astronomical day length at the station's latitude. where restricts the
+// days counted, see parseWhere.
+func (s *server) handleSunshine(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, err := parseWhere(values.Get("where"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	interval, err := parseInterval(values.Get("interval"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var possibleHours *float64
+	if v := values.Get("possibleHours"); v != "" {
+		hours, err := strconv.ParseFloat(v, 64)
+		if err != nil || hours <= 0 || hours > 24 {
+			httpError(w, r, "Invalid request. possibleHours must be a number of hours between 0 and 24.", http.StatusBadRequest)
+			return
+		}
+		possibleHours = &hours
+	}
+
+	var latitude float64
+	err = s.db.QueryRowContext(r.Context(), "SELECT latitude FROM \"Station\" WHERE station_number = $1", stationNumber).Scan(&latitude)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	cond, args := where.sql([]interface{}{stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")})
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", ss FROM \"Weather\" WHERE station_number = $1 AND ss IS NOT NULL AND \"Tanggal\" BETWEEN $2 AND $3"+cond+" ORDER BY \"Tanggal\"",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type sunshineInterval struct {
+		Period        string   `json:"period"`
+		TotalHours    float64  `json:"total_hours"`
+		Days          int      `json:"days"`
+		PossibleHours float64  `json:"possible_hours"`
+		Percent       *float64 `json:"percent"`
+		dataCoverage
+	}
+	intervals := []*sunshineInterval{}
+	for rows.Next() {
+		var tanggal string
+		var ss float64
+		if err := rows.Scan(&tanggal, &ss); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		day, err := time.Parse("2006-01-02", tanggal)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		// Rows are ordered by date, so intervals arrive in order too
+		key := intervalKey(tanggal, interval)
+		if len(intervals) == 0 || intervals[len(intervals)-1].Period != key {
+			intervals = append(intervals, &sunshineInterval{Period: key})
+		}
+		current := intervals[len(intervals)-1]
+		current.TotalHours += ss
+		current.Days++
+		if possibleHours != nil {
+			current.PossibleHours += *possibleHours
+		} else {
+			current.PossibleHours += dayLength(latitude, day)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	for _, iv := range intervals {
+		iv.dataCoverage = newDataCoverage(iv.Days, periodDays(iv.Period, interval, startDate, endDate))
+		if iv.PossibleHours > 0 {
+			percent := iv.TotalHours / iv.PossibleHours * 100
+			iv.Percent = &percent
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string              `json:"station_number"`
+		Interval      string              `json:"interval"`
+		Latitude      float64             `json:"latitude"`
+		Intervals     []*sunshineInterval `json:"intervals"`
+	}{stationNumber, interval, latitude, intervals})
+}
+
+// comparisonOps maps the comparison names accepted in query parameters onto
+// their SQL operators.
+var comparisonOps = map[string]string{
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+	"eq":  "=",
+}
+
+// whereOps are the operators of a where condition, two-character ones first
+// so that >= is not read as >.
+var whereOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// whereClause is a secondary condition on another column restricting which
+// days an aggregation covers, e.g. rr>1 for rainy days only. The zero value
+// restricts nothing.
+type whereClause struct {
+	Column string
+	Op     string
+	Value  float64
+}
+
+// parseWhere reads a where parameter of the form <column><op><number>. The
+// column must be a stored weather column other than a wind direction, which
+// wraps around rather than ordering, and the operator one of whereOps, so
+// that only the number reaches the query, as an argument.
+func parseWhere(v string) (whereClause, error) {
+	if v == "" {
+		return whereClause{}, nil
+	}
+	for i := range v {
+		for _, op := range whereOps {
+			if !strings.HasPrefix(v[i:], op) {
+				continue
+			}
+			column := strings.TrimSpace(v[:i])
+			if !isWeatherColumn(column) {
+				return whereClause{}, errors.New("where must name a known column, e.g. rr>1.")
+			}
+			if err := linearColumn(column); err != nil {
+				return whereClause{}, err
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(v[i+len(op):]), 64)
+			if err != nil {
+				return whereClause{}, errors.New("where must compare the column with a number, e.g. rr>1.")
+			}
+			return whereClause{column, op, value}, nil
+		}
+	}
+	return whereClause{}, errors.New("where must be a condition such as rr>1, using one of >, >=, <, <=, = or !=.")
+}
+
+// sql returns the condition as an AND clause comparing with the next
+// placeholder, appending the value to args, or leaves both alone for the
+// zero value.
+func (c whereClause) sql(args []interface{}) (string, []interface{}) {
+	if c.Column == "" {
+		return "", args
+	}
+	args = append(args, c.Value)
+	return " AND \"" + c.Column + "\" " + c.Op + " $" + strconv.Itoa(len(args)), args
+}
+
+// handleThreshold counts the days on which a column satisfies a comparison
+// against a value, e.g. frost days with type=tn&op=lt&value=0. NULL readings
+// never qualify. With interval=month or interval=year the counts are also
+// broken down per period. where restricts the days considered, e.g. hot days
+// among the dry ones with type=tx&op=gt&value=33&where=rr=0.
+func (s *server) handleThreshold(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+
+	op, ok := comparisonOps[values.Get("op")]
+	if !ok {
+		httpError(w, r, "Invalid request. op must be one of lt, lte, gt, gte or eq.", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := strconv.ParseFloat(values.Get("value"), 64)
+	if err != nil {
+		httpError(w, r, "Invalid request. value must be a number.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, err := parseWhere(values.Get("where"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	interval := values.Get("interval")
+	if interval != "" && interval != "month" && interval != "year" {
+		httpError(w, r, "Invalid request. interval must be either month or year.", http.StatusBadRequest)
+		return
+	}
+
+	// Every day with a reading is read, not just the qualifying ones, so the
+	// counts can be put against the days actually observed
+	cond, args := where.sql([]interface{}{stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), threshold})
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", \""+dataType+"\" "+op+" $4 FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND \""+dataType+"\" IS NOT NULL"+cond+" ORDER BY \"Tanggal\"",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type thresholdPeriod struct {
+		Period string   `json:"period"`
+		Count  int      `json:"count"`
+		Dates  []string `json:"dates"`
+		dataCoverage
+	}
+	dates := []string{}
+	observed := 0
+	var periods []*thresholdPeriod
+	for rows.Next() {
+		var tanggal string
+		var hit bool
+		if err := rows.Scan(&tanggal, &hit); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		observed++
+		if hit {
+			dates = append(dates, tanggal)
+		}
+
+		if interval != "" {
+			key := intervalKey(tanggal, interval)
+			if len(periods) == 0 || periods[len(periods)-1].Period != key {
+				periods = append(periods, &thresholdPeriod{Period: key, Dates: []string{}})
+			}
+			current := periods[len(periods)-1]
+			current.N++
+			if hit {
+				current.Count++
+				current.Dates = append(current.Dates, tanggal)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, p := range periods {
+		p.dataCoverage = newDataCoverage(p.N, periodDays(p.Period, interval, startDate, endDate))
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string             `json:"station_number"`
+		Type          string             `json:"type"`
+		Op            string             `json:"op"`
+		Value         float64            `json:"value"`
+		Count         int                `json:"count"`
+		Dates         []string           `json:"dates"`
+		Periods       []*thresholdPeriod `json:"periods,omitempty"`
+		dataCoverage
+	}{stationNumber, dataType, values.Get("op"), threshold, len(dates), dates, periods,
+		newDataCoverage(observed, daysBetween(startDate, endDate))})
+}
+
+// dailySeries loads a station's non-NULL readings of column between start and
+// end inclusive, keyed by YYYY-MM-DD. Missing days are simply absent.
+func (s *server) dailySeries(ctx context.Context, stationNumber, column string, start, end time.Time) (map[string]float64, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT \"Tanggal\", \""+column+"\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND \""+column+"\" IS NOT NULL",
+		stationNumber, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := map[string]float64{}
+	for rows.Next() {
+		var tanggal string
+		var value float64
+		if err := rows.Scan(&tanggal, &value); err != nil {
+			return nil, err
+		}
+		series[tanggal] = value
+	}
+	return series, rows.Err()
+}
+
+// gslMinCoverage is the fraction of days in the season year that need a tavg
+// reading for the growing season length to be reported.
+const gslMinCoverage = 0.8
+
+// handleGSL computes the ETCCDI growing season length for a year: the days
+// from the first run of 6 days with tavg above base to the first run of 6
+// days with tavg below base in the second half of the year. Southern
+// hemisphere stations use a season year running from 1 July to 30 June. A
+// missing day breaks a run.
+func (s *server) handleGSL(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(values.Get("year"))
+	if err != nil || year < 1 || year > 9999 {
+		httpError(w, r, "Invalid request. year must be a four digit year.", http.StatusBadRequest)
+		return
+	}
+
+	base := 5.0
+	if v := values.Get("base"); v != "" {
+		base, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			httpError(w, r, "Invalid request. base must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	station, err := s.lookupStation(r.Context(), stationNumber)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	seasonStart := time.Date(year, time.January, 1, 0, 0, 0, 0, stationTZ)
+	if station.Latitude < 0 {
+		seasonStart = time.Date(year, time.July, 1, 0, 0, 0, 0, stationTZ)
+	}
+	seasonEnd := seasonStart.AddDate(1, 0, -1)
+	midSeason := seasonStart.AddDate(0, 6, 0)
+
+	tavg, err := s.dailySeries(r.Context(), stationNumber, "tavg", seasonStart, seasonEnd)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	result := struct {
+		StationNumber string  `json:"station_number"`
+		Year          int     `json:"year"`
+		Base          float64 `json:"base"`
+		Status        string  `json:"status"`
+		StartDate     *string `json:"start_date"`
+		EndDate       *string `json:"end_date"`
+		Length        *int    `json:"length_days"`
+		DaysWithData  int     `json:"days_with_data"`
+		DaysInSeason  int     `json:"days_in_season"`
+		dataCoverage
+	}{StationNumber: stationNumber, Year: year, Base: base, DaysWithData: len(tavg)}
+	result.DaysInSeason = daysBetween(seasonStart, seasonEnd)
+	result.dataCoverage = newDataCoverage(result.DaysWithData, result.DaysInSeason)
+
+	if float64(result.DaysWithData) < gslMinCoverage*float64(result.DaysInSeason) {
+		result.Status = "incomplete"
+		writeJSON(w, r, result)
+		return
+	}
+	result.Status = "ok"
+
+	// Walk the season looking for the first warm spell, then for the first
+	// cold spell after mid-season
+	var start, end time.Time
+	run := 0
+	for day := seasonStart; !day.After(seasonEnd); day = day.AddDate(0, 0, 1) {
+		v, ok := tavg[day.Format("2006-01-02")]
+		if start.IsZero() {
+			if ok && v > base {
+				run++
+			} else {
+				run = 0
+			}
+			if run == 6 {
+				start = day.AddDate(0, 0, -5)
+				run = 0
+			}
+			continue
+		}
+		if day.Before(midSeason) {
+			continue
+		}
+		if ok && v < base {
+			run++
+		} else {
+			run = 0
+		}
+		if run == 6 {
+			end = day.AddDate(0, 0, -6)
+			break
+		}
+	}
+
+	// Without a warm spell there is no season; without a cold spell the season
+	// lasts until the end of the year
+	length := 0
+	if !start.IsZero() {
+		if end.IsZero() {
+			end = seasonEnd
+		}
+		startDate, endDate := start.Format("2006-01-02"), end.Format("2006-01-02")
+		result.StartDate, result.EndDate = &startDate, &endDate
+		length = int(end.Sub(start).Hours()/24+0.5) + 1
+	}
+	result.Length = &length
+
+	writeJSON(w, r, result)
+}
+
+// handleDiurnal returns the mean diurnal cycle of a column: its average per
+// hour of day over a date range. This needs sub-daily observations, whose
+// Tanggal carries a time after the date ("2023-01-01 13:00" or
+// "2023-01-01T13:00"); with only daily records there is no cycle to compute
+// and the request is answered with 422. where restricts the readings
+// averaged. Each hour reports n, its number of readings, and the fraction of
+// days with at least one as completeness.
+func (s *server) handleDiurnal(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, err := parseWhere(values.Get("where"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Timestamps sort after their bare date, so the range ends before the
+	// following day rather than at the end date itself
+	cond, args := where.sql([]interface{}{stationNumber, startDate.Format("2006-01-02"), endDate.AddDate(0, 0, 1).Format("2006-01-02")})
+	rows, err := s.db.QueryContext(r.Context(), "SELECT CAST(SUBSTRING(\"Tanggal\", 12, 2) AS integer), AVG(\""+dataType+"\"), COUNT(\""+dataType+"\"), COUNT(DISTINCT SUBSTRING(\"Tanggal\", 1, 10)) FILTER (WHERE \""+dataType+"\" IS NOT NULL) FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" >= $2 AND \"Tanggal\" < $3 AND LENGTH(\"Tanggal\") >= 13 AND SUBSTRING(\"Tanggal\", 12, 2) ~ '^[0-9]{2}$' "+cond+" GROUP BY 1 ORDER BY 1",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type hourMean struct {
+		Hour int      `json:"hour"`
+		Mean *float64 `json:"mean"`
+		dataCoverage
+	}
+	hours := make([]hourMean, 24)
+	for h := range hours {
+		hours[h].Hour = h
+	}
+	subDaily := false
+	for rows.Next() {
+		var hour, n, days int
+		var mean sql.NullFloat64
+		if err := rows.Scan(&hour, &mean, &n, &days); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		subDaily = true
+		if hour < 0 || hour > 23 {
+			continue
+		}
+		// Readings may come more than once an hour, so completeness counts
+		// the days with one rather than the readings themselves
+		hours[hour].dataCoverage = newDataCoverage(days, daysBetween(startDate, endDate))
+		hours[hour].N = n
+		if mean.Valid {
+			hours[hour].Mean = &mean.Float64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if !subDaily {
+		httpError(w, r, "Only daily observations are available for this station and date range. A diurnal cycle needs sub-daily readings.", http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string     `json:"station_number"`
+		Type          string     `json:"type"`
+		Hours         []hourMean `json:"hours"`
+	}{stationNumber, dataType, hours})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKey is a machine client's key, configured in API_KEYS.
+type apiKey struct {
+	Name string
+	key  string
+
+	// limit is the number of requests allowed per minute, 0 for no limit
+	limit int
+
+	// scopes are the route features the key may use; nil allows them all
+	scopes map[string]bool
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// parseAPIKeys parses API_KEYS, a comma-separated list of
+// name:key[:limit[:scopes]] entries. limit is requests per minute, empty or 0
+// for unlimited, and scopes a +-separated list of route features, e.g.
+// "dashboard:s3cret:120:data+stations".
+func parseAPIKeys(v string) ([]*apiKey, error) {
+	var keys []*apiKey
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("entries must be name:key[:limit[:scopes]]")
+		}
+		k := &apiKey{Name: parts[0], key: parts[1]}
+		if len(parts) > 2 && parts[2] != "" {
+			limit, err := strconv.Atoi(parts[2])
+			if err != nil || limit < 0 {
+				return nil, errors.New("limit of key " + strconv.Quote(k.Name) + " must be a number of requests per minute")
+			}
+			k.limit = limit
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			k.scopes = map[string]bool{}
+			for _, scope := range strings.Split(parts[3], "+") {
+				if err := checkFeatureList(scope); err != nil {
+					return nil, err
+				}
+				k.scopes[scope] = true
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// lookupAPIKey finds the key matching secret, comparing in constant time.
+func lookupAPIKey(secret string) *apiKey {
+	var found *apiKey
+	for _, k := range config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(k.key)) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+// allow counts a request against the key's per-minute limit.
+func (k *apiKey) allow(now time.Time) bool {
+	if k.limit == 0 {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now.Sub(k.windowStart) >= time.Minute {
+		k.windowStart, k.count = now, 0
+	}
+	k.count++
+	return k.count <= k.limit
+}
+
+// checkAPIKey authenticates the X-API-Key header of requests to a route of
+// the given feature. A key is only required with API_KEY_REQUIRED=true, but
+// one that is sent is always checked, so clients can be told apart in the
+// access log even on open deployments.
+func checkAPIKey(feature string, next http.HandlerFunc) http.HandlerFunc {
+	required := config.APIKeyRequired
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" {
+			if required {
+				httpError(w, r, "Missing API key.", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		k := lookupAPIKey(secret)
+		if k == nil {
+			httpError(w, r, "Invalid API key.", http.StatusUnauthorized)
+			return
+		}
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.apiKey = k.Name
+		}
+		if k.scopes != nil && !k.scopes[feature] {
+			httpError(w, r, "API key is not allowed to use this endpoint.", http.StatusForbidden)
+			return
+		}
+		if !k.allow(time.Now()) {
+			w.Header().Set("Retry-After", "60")
+			httpError(w, r, "API key rate limit exceeded.", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestInfoKey is the context key of the requestInfo that logRequests
+// attaches to each request.
+type requestInfoKey struct{}
+
+// requestInfo collects details that handlers learn about a request and the
+// access log reports afterwards.
+type requestInfo struct {
+	apiKey string
+}
+
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
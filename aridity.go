@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deMartonneCategories classify the De Martonne aridity index P/(T+10).
+var deMartonneCategories = []fieldCategory{
+	{Label: "arid", Max: bound(10)},
+	{Label: "semi_arid", Min: bound(10), Max: bound(20)},
+	{Label: "mediterranean", Min: bound(20), Max: bound(24)},
+	{Label: "semi_humid", Min: bound(24), Max: bound(28)},
+	{Label: "humid", Min: bound(28), Max: bound(35)},
+	{Label: "very_humid", Min: bound(35), Max: bound(55)},
+	{Label: "extremely_humid", Min: bound(55)},
+}
+
+// thornthwaiteCategories classify the Thornthwaite moisture index into his
+// 1948 climate types, the humid B1 to B4 types taken together.
+var thornthwaiteCategories = []fieldCategory{
+	{Label: "arid", Max: bound(-66.7)},
+	{Label: "semiarid", Min: bound(-66.7), Max: bound(-33.3)},
+	{Label: "dry_subhumid", Min: bound(-33.3), Max: bound(0)},
+	{Label: "moist_subhumid", Min: bound(0), Max: bound(20)},
+	{Label: "humid", Min: bound(20), Max: bound(100)},
+	{Label: "perhumid", Min: bound(100)},
+}
+
+// thornthwaitePET returns the annual potential evapotranspiration in mm by
+// Thornthwaite's method from the monthly mean temperatures, each month's
+// value adjusted for its mean day length at the latitude and its number of
+// days. Months from 26.5 °C use his table for hot months instead of the
+// power law.
+func thornthwaitePET(latitude float64, temps [12]float64) float64 {
+	heat := 0.0
+	for _, t := range temps {
+		if t > 0 {
+			heat += math.Pow(t/5, 1.514)
+		}
+	}
+	if heat == 0 {
+		return 0
+	}
+	a := 6.75e-7*math.Pow(heat, 3) - 7.71e-5*heat*heat + 1.792e-2*heat + 0.49239
+
+	total := 0.0
+	for m, t := range temps {
+		var pet float64
+		switch {
+		case t <= 0:
+			continue
+		case t >= 26.5:
+			pet = -415.85 + 32.24*t - 0.43*t*t
+		default:
+			pet = 16 * math.Pow(10*t/heat, a)
+		}
+		// A common year stands in for the month lengths and mid-month days
+		first := time.Date(2001, time.Month(m+1), 1, 0, 0, 0, 0, time.UTC)
+		days := first.AddDate(0, 1, -1).Day()
+		hours := dayLength(latitude, first.AddDate(0, 0, 14))
+		total += pet * hours / 12 * float64(days) / 30
+	}
+	return total
+}
+
+// handleAridity classifies a station's climate by the De Martonne aridity
+// index P/(T+10), from its annual precipitation P in mm and annual mean
+// temperature T in °C, and by the Thornthwaite moisture index 100(P-PE)/PE
+// against the potential evapotranspiration PE. Both come from the monthly
+// normals over the station's full history, so every month needs minYears
+// years of data.
+func (s *server) handleAridity(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	station, err := s.lookupStation(r.Context(), stationNumber)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	normals, err := s.monthlyNormals(r.Context(), stationNumber, minYears)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	type index struct {
+		Value *float64    `json:"value"`
+		Class interface{} `json:"class"`
+	}
+	result := struct {
+		StationNumber       string   `json:"station_number"`
+		StationName         string   `json:"station_name"`
+		MinYears            int      `json:"min_years"`
+		Status              string   `json:"status"`
+		AnnualTemperature   *float64 `json:"annual_mean_temperature"`
+		AnnualPrecipitation *float64 `json:"annual_precipitation"`
+		AnnualPET           *float64 `json:"annual_pet"`
+		DeMartonne          index    `json:"de_martonne"`
+		Thornthwaite        index    `json:"thornthwaite"`
+	}{
+		StationNumber: stationNumber,
+		StationName:   station.StationName,
+		MinYears:      minYears,
+		Status:        "insufficient_history",
+	}
+
+	var temps [12]float64
+	var tempSum, precipSum float64
+	complete := true
+	for i, n := range normals {
+		if n.Tavg.Value == nil || n.RR.Value == nil {
+			complete = false
+			break
+		}
+		temps[i] = *n.Tavg.Value
+		tempSum += *n.Tavg.Value
+		precipSum += *n.RR.Value
+	}
+
+	// Annual figures need all twelve months
+	if complete {
+		result.Status = "ok"
+		annualTemp := tempSum / 12
+		result.AnnualTemperature, result.AnnualPrecipitation = &annualTemp, &precipSum
+
+		// The index is undefined at and below -10 °C
+		if annualTemp > -10 {
+			dm := precipSum / (annualTemp + 10)
+			result.DeMartonne = index{&dm, classify(deMartonneCategories, dm)}
+		}
+		pet := thornthwaitePET(station.Latitude, temps)
+		result.AnnualPET = &pet
+		if pet > 0 {
+			im := 100 * (precipSum - pet) / pet
+			result.Thornthwaite = index{&im, classify(thornthwaiteCategories, im)}
+		}
+	}
+
+	writeJSON(w, r, result)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheBudget accounts the memory held by the in-memory caches against one
+// total, so that together they stay within it however diverse the queries.
+// A cache that would push the total over the limit evicts its own least
+// recently used entries to make room.
+type cacheBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// cacheMemory is the budget shared by every cache. main sizes it to
+// CACHE_MEMORY_BYTES before any cache is created.
+var cacheMemory = &cacheBudget{}
+
+// fits reports whether n more bytes stay within the budget.
+func (b *cacheBudget) fits(n int64) bool {
+	return b.used.Load()+n <= b.limit
+}
+
+// responseCache is an LRU cache of successful GET responses, keyed by path
+// and normalized query. Entries expire after ttl and are dropped early when
+// the data of their station changes. Their memory counts against budget.
+type responseCache struct {
+	size   int
+	ttl    time.Duration
+	budget *cacheBudget
+
+	// staleIfError keeps expired entries around, until evicted, to answer
+	// in place of a failed response
+	staleIfError bool
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+
+	hits, misses, evictions, staleHits atomic.Int64
+}
+
+type cacheEntry struct {
+	key      string
+	stations []string
+	expires  time.Time
+	status   int
+	header   http.Header
+	body     []byte
+}
+
+// bytes approximates the memory an entry holds.
+func (e *cacheEntry) bytes() int64 {
+	n := len(e.key) + len(e.body) + 128
+	for _, station := range e.stations {
+		n += len(station)
+	}
+	for k, vs := range e.header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+// newResponseCache returns a cache of up to size responses, or nil, which
+// caches nothing, for a size of zero or less.
+func newResponseCache(size int, ttl time.Duration, budget *cacheBudget, staleIfError bool) *responseCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &responseCache{size: size, ttl: ttl, budget: budget, staleIfError: staleIfError, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// remove drops an element; c.mu must be held.
+func (c *responseCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.order.Remove(el)
+	delete(c.entries, entry.key)
+	c.budget.used.Add(-entry.bytes())
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		if !c.staleIfError {
+			c.remove(el)
+		}
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+// stale returns the entry for key even when it has expired.
+func (c *responseCache) stale(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+
+	// Make room by entry count and by memory; a response too large for the
+	// whole budget is not cached at all
+	size := entry.bytes()
+	if size > c.budget.limit {
+		return
+	}
+	for c.order.Len() > 0 && (c.order.Len() >= c.size || !c.budget.fits(size)) {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+	if !c.budget.fits(size) {
+		// Other caches hold the rest of the budget
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.budget.used.Add(size)
+}
+
+// len returns the number of cached responses.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// invalidateStation drops the cached responses of a station, including those
+// it was one of several stations in. It is safe to call on a nil cache.
+func (c *responseCache) invalidateStation(stationNumber string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		for _, station := range el.Value.(*cacheEntry).stations {
+			if station == stationNumber {
+				c.remove(el)
+				break
+			}
+		}
+	}
+}
+
+// clear drops every cached response. It is safe to call on a nil cache.
+func (c *responseCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		c.remove(el)
+	}
+}
+
+// wrap serves GET requests from the cache where it can and caches the 200
+// responses of next. The key is the path with the query in canonical order,
+// so reordered parameters share an entry. X-Cache tells HIT from MISS.
+func (c *responseCache) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// An explained response is about this one request
+		if r.Method != http.MethodGet || explaining(r.Context()) {
+			next(w, r)
+			return
+		}
+
+		values := r.URL.Query()
+		key := r.URL.Path + "?" + values.Encode()
+		if entry, ok := c.get(key); ok {
+			c.hits.Add(1)
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+		c.misses.Add(1)
+
+		// With an expired entry to fall back on, the response is held back
+		// until it is known to have succeeded; a failure gets the entry
+		// instead, marked X-Cache: stale and warned about both in a Warning
+		// header and, for a JSON object, under warnings in the body
+		if entry, ok := c.stale(key); ok && c.staleIfError {
+			buf := &bufferedResponse{header: http.Header{}}
+			next(buf, r)
+			buf.status = buf.code()
+			if buf.status >= http.StatusInternalServerError {
+				c.staleHits.Add(1)
+				for k, v := range entry.header {
+					w.Header()[k] = v
+				}
+				warning := "Revalidation failed, serving data cached at " + entry.expires.Add(-c.ttl).UTC().Format(time.RFC3339)
+				w.Header().Set("X-Cache", "stale")
+				w.Header().Set("Warning", `111 - "`+warning+`"`)
+				body := entry.body
+				if warned, ok := withWarning(entry.header, body, warning); ok {
+					body = warned
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				w.WriteHeader(entry.status)
+				w.Write(body)
+				return
+			}
+			for k, v := range buf.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "MISS")
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			if buf.status == http.StatusOK {
+				c.put(&cacheEntry{
+					key:      key,
+					stations: cacheStations(values),
+					expires:  time.Now().Add(c.ttl),
+					status:   buf.status,
+					header:   buf.header,
+					body:     buf.body.Bytes(),
+				})
+			}
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w, header: http.Header{}}
+		next(rec, r)
+		if rec.status == http.StatusOK {
+			c.put(&cacheEntry{
+				key:      key,
+				stations: cacheStations(values),
+				expires:  time.Now().Add(c.ttl),
+				status:   rec.status,
+				header:   rec.header,
+				body:     rec.body.Bytes(),
+			})
+		}
+	}
+}
+
+// withWarning adds warning to a JSON object response under warnings, as
+// /input/data reports its own. Other bodies, and objects that have warnings
+// already, are left alone.
+func withWarning(header http.Header, body []byte, warning string) ([]byte, bool) {
+	if !strings.Contains(header.Get("Content-Type"), "json") {
+		return nil, false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+	if _, ok := fields["warnings"]; ok {
+		return nil, false
+	}
+
+	// The key goes first, so that the others keep their order
+	warnings, _ := json.Marshal([]string{warning})
+	rest := bytes.TrimSpace(body)[1:]
+	out := append([]byte(`{"warnings":`), warnings...)
+	if len(fields) > 0 {
+		out = append(out, ',')
+	}
+	return append(out, rest...), true
+}
+
+// cacheStations returns the stations a request reads, from stationNumber and
+// the comma-separated stations list, in the form invalidateStation is given.
+func cacheStations(values url.Values) []string {
+	var stations []string
+	for _, v := range append([]string{values.Get("stationNumber")}, strings.Split(values.Get("stations"), ",")...) {
+		v = strings.TrimSpace(v)
+		if n, err := strconv.Atoi(v); err == nil {
+			v = strconv.Itoa(n)
+		}
+		if v != "" {
+			stations = append(stations, v)
+		}
+	}
+	return stations
+}
+
+// cacheRecorder passes a response through while keeping a copy of it. The
+// handler's headers are kept apart from those of the writer underneath, so
+// that what compress adds, such as Content-Encoding, stays out of the cache
+// along with the compressed body it describes.
+type cacheRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *cacheRecorder) Header() http.Header { return c.header }
+
+func (c *cacheRecorder) WriteHeader(code int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = code
+	for k, v := range c.header {
+		c.ResponseWriter.Header()[k] = v
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheRecorder) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestCacheHitThroughCompress checks that a cached response is served intact
+// behind compress, both to clients that accept gzip and to those that do not,
+// whichever kind of client caused it to be cached.
+func TestCacheHitThroughCompress(t *testing.T) {
+	const body = `{"months":[]}`
+	for _, first := range []string{"gzip", ""} {
+		cacheMemory.limit = 1 << 20
+		cache := newResponseCache(16, time.Minute, cacheMemory, false)
+		h := compress(cache.wrap(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+
+		for i, encoding := range []string{first, "gzip", ""} {
+			req := httptest.NewRequest("GET", "/aggregate/monthly?stationNumber=1", nil)
+			if encoding != "" {
+				req.Header.Set("Accept-Encoding", encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			wantCache := "HIT"
+			if i == 0 {
+				wantCache = "MISS"
+			}
+			if got := rec.Header().Get("X-Cache"); got != wantCache {
+				t.Errorf("first=%q request %d: X-Cache = %q, want %q", first, i, got, wantCache)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("first=%q request %d: Content-Encoding = %q, want %q", first, i, got, encoding)
+			}
+
+			var r io.Reader = rec.Body
+			if encoding == "gzip" {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("first=%q request %d: %v", first, i, err)
+				}
+				r = gz
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("first=%q request %d: reading body: %v", first, i, err)
+			}
+			if string(got) != body {
+				t.Errorf("first=%q request %d: body = %q, want %q", first, i, got, body)
+			}
+		}
+	}
+}
+
+// TestCacheInvalidateStation checks that a station's changes drop the cached
+// responses that read it, whether through stationNumber or a stations list.
+func TestCacheInvalidateStation(t *testing.T) {
+	cacheMemory.limit = 1 << 20
+	cache := newResponseCache(16, time.Minute, cacheMemory, false)
+	h := cache.wrap(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	for _, target := range []string{
+		"/aggregate/monthly?stationNumber=1",
+		"/aggregate/monthly?stationNumber=2",
+		"/aggregate/regional?stations=3,+1&type=rr",
+		"/aggregate/regional?stations=2,3&type=rr",
+	} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	cache.invalidateStation("1")
+	if got := cache.len(); got != 2 {
+		t.Errorf("after invalidating station 1, %d responses are cached, want 2", got)
+	}
+	cache.invalidateStation("3")
+	if got := cache.len(); got != 1 {
+		t.Errorf("after invalidating station 3, %d responses are cached, want 1", got)
+	}
+}
+
+// TestCacheStaleIfError checks that a failed revalidation serves the expired
+// response with a warning in its body, and that a handler writing nothing
+// counts as a 200.
+func TestCacheStaleIfError(t *testing.T) {
+	cacheMemory.limit = 1 << 20
+	cache := newResponseCache(16, time.Millisecond, cacheMemory, true)
+	var status int
+	h := cache.wrap(func(w http.ResponseWriter, r *http.Request) {
+		switch status {
+		case http.StatusOK:
+			writeJSON(w, r, struct {
+				Total float64 `json:"total"`
+			}{12.5})
+		case 0:
+		default:
+			httpError(w, r, "Internal server error.", status)
+		}
+	})
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/aggregate/monthly?stationNumber=1", nil))
+		return rec
+	}
+
+	status = http.StatusOK
+	serve()
+	time.Sleep(5 * time.Millisecond)
+
+	status = http.StatusInternalServerError
+	rec := serve()
+	if got := rec.Header().Get("X-Cache"); got != "stale" {
+		t.Fatalf("X-Cache = %q, want stale", got)
+	}
+	var body struct {
+		Total    float64  `json:"total"`
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("stale body %q: %v", rec.Body, err)
+	}
+	if body.Total != 12.5 || len(body.Warnings) != 1 {
+		t.Errorf("stale body = %+v, want the cached total and one warning", body)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length = %s, body has %d bytes", got, rec.Body.Len())
+	}
+
+	status = 0
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Errorf("empty response status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// calendarDay is one cell of a calendar heatmap.
+type calendarDay struct {
+	Date    string   `json:"date"`
+	Weekday int      `json:"weekday"`
+	Value   *float64 `json:"value"`
+}
+
+// calendarWeek is one column of a calendar heatmap: seven days from Monday,
+// with null for the days outside the year.
+type calendarWeek struct {
+	Start string         `json:"start"`
+	Days  []*calendarDay `json:"days"`
+}
+
+// handleCalendar returns a year of one column laid out for a calendar
+// heatmap, a column per week and a row per weekday, 0 for Monday through 6
+// for Sunday. Every day of the year is present, with a null value when
+// nothing was recorded, and min and max span the values for a colour scale.
+func (s *server) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(values.Get("year"))
+	if err != nil || year < 1 || year > 9999 {
+		httpError(w, r, "Invalid request. year must be a four digit year.", http.StatusBadRequest)
+		return
+	}
+
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, stationTZ)
+	last := first.AddDate(1, 0, -1)
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", \""+dataType+"\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND \""+dataType+"\" IS NOT NULL",
+		stationNumber, first.Format("2006-01-02"), last.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	readings := map[string]float64{}
+	for rows.Next() {
+		var tanggal string
+		var value float64
+		if err := rows.Scan(&tanggal, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		readings[tanggal] = value
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// The first week starts on the Monday on or before 1 January
+	var min, max *float64
+	weeks := []calendarWeek{}
+	start := first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+	for week := start; !week.After(last); week = week.AddDate(0, 0, 7) {
+		cw := calendarWeek{Start: week.Format("2006-01-02"), Days: make([]*calendarDay, 7)}
+		for i := range cw.Days {
+			day := week.AddDate(0, 0, i)
+			if day.Year() != year {
+				continue
+			}
+			d := &calendarDay{Date: day.Format("2006-01-02"), Weekday: i}
+			if v, ok := readings[d.Date]; ok {
+				d.Value = &v
+				if min == nil || v < *min {
+					min = &v
+				}
+				if max == nil || v > *max {
+					max = &v
+				}
+			}
+			cw.Days[i] = d
+		}
+		weeks = append(weeks, cw)
+	}
+
+	column, _ := lookupColumn(dataType)
+	writeJSON(w, r, struct {
+		StationNumber string         `json:"station_number"`
+		Type          string         `json:"type"`
+		Unit          string         `json:"unit"`
+		Year          int            `json:"year"`
+		Days          int            `json:"days_with_data"`
+		Min           *float64       `json:"min"`
+		Max           *float64       `json:"max"`
+		Weeks         []calendarWeek `json:"weeks"`
+	}{stationNumber, dataType, column.Unit, year, len(readings), min, max, weeks})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// spellMinCoverage is the fraction of a year's days that need an rr reading
+// for its longest dry and wet spells to be reported.
+const spellMinCoverage = 0.8
+
+// longestSpell is the longest run of dry or wet days in a year, nil dates
+// when there was none.
+type longestSpell struct {
+	Days  int     `json:"days"`
+	Start *string `json:"start"`
+	End   *string `json:"end"`
+}
+
+// handleCDDCWD computes the ETCCDI indices CDD, the largest number of
+// consecutive days in a year with rr below threshold, 1 mm by default, and
+// CWD, the largest number with rr at or above it, together with when the
+// longest spells ran; the earliest wins a tie. A day without a reading ends
+// a spell, so spells never bridge a gap, and years with fewer than 80% of
+// days recorded are reported as "insufficient data".
+func (s *server) handleCDDCWD(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(values.Get("year"))
+	if err != nil || year < 1 || year > 9999 {
+		httpError(w, r, "Invalid request. year must be a four digit year.", http.StatusBadRequest)
+		return
+	}
+
+	threshold := 1.0
+	if v := values.Get("threshold"); v != "" {
+		threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			httpError(w, r, "Invalid request. threshold must be a positive number of mm.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, stationTZ)
+	last := first.AddDate(1, 0, -1)
+	rr, err := s.dailySeries(r.Context(), stationNumber, "rr", first, last)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	result := struct {
+		StationNumber string        `json:"station_number"`
+		Year          int           `json:"year"`
+		Threshold     float64       `json:"threshold"`
+		Status        string        `json:"status"`
+		CDD           *longestSpell `json:"cdd"`
+		CWD           *longestSpell `json:"cwd"`
+		dataCoverage
+	}{StationNumber: stationNumber, Year: year, Threshold: threshold, Status: "insufficient data"}
+	days := daysBetween(first, last)
+	result.dataCoverage = newDataCoverage(len(rr), days)
+	if float64(len(rr)) < spellMinCoverage*float64(days) {
+		writeJSON(w, r, result)
+		return
+	}
+	result.Status = "ok"
+
+	// Track the current dry and wet runs; at most one of them is going
+	dry, wet := &longestSpell{}, &longestSpell{}
+	var run int
+	var runStart string
+	runWet := false
+	end := func(date string) {
+		longest := dry
+		if runWet {
+			longest = wet
+		}
+		if run > longest.Days {
+			start, end := runStart, date
+			longest.Days, longest.Start, longest.End = run, &start, &end
+		}
+		run = 0
+	}
+	previous := ""
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		v, ok := rr[date]
+		if !ok || (run > 0 && (v >= threshold) != runWet) {
+			end(previous)
+		}
+		if ok {
+			if run == 0 {
+				runStart, runWet = date, v >= threshold
+			}
+			run++
+		}
+		previous = date
+	}
+	end(previous)
+	result.CDD, result.CWD = dry, wet
+
+	writeJSON(w, r, result)
+}
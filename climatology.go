@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// normalValue is a long-term monthly average together with the number of
+// years it was computed over. Value is nil when too few years are available.
+type normalValue struct {
+	Value *float64 `json:"value"`
+	Years int      `json:"years"`
+}
+
+// monthNormal holds the climate normals of one calendar month: mean
+// temperature, mean monthly rainfall total and mean humidity.
+type monthNormal struct {
+	Month int         `json:"month"`
+	Tavg  normalValue `json:"tavg"`
+	RR    normalValue `json:"rr"`
+	RHavg normalValue `json:"rh_avg"`
+}
+
+// parseMinYears reads the minYears parameter, defaulting to
+// NORMALS_MIN_YEARS.
+func parseMinYears(v string) (int, bool) {
+	if v == "" {
+		return config.NormalsMinYears, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 1
+}
+
+// monthlyNormals computes the station's normals for each calendar month over
+// every year on record. Each year contributes its monthly mean tavg, monthly
+// rr total and monthly mean rh_avg; a total only counts with rr on at least
+// 80% of the month's days, as a sum over fewer falls short of the true one.
+// Months with fewer than minYears contributing years get a nil value.
+func (s *server) monthlyNormals(ctx context.Context, stationNumber string, minYears int) ([12]monthNormal, error) {
+	var normals [12]monthNormal
+	var sums [12][3]float64
+
+	rows, err := s.db.QueryContext(ctx, "SELECT CAST(SUBSTRING(\"Tanggal\", 1, 4) AS integer), CAST(SUBSTRING(\"Tanggal\", 6, 2) AS integer), AVG(tavg), SUM(rr), COUNT(rr), AVG(rh_avg) FROM \"Weather\" WHERE station_number = $1 GROUP BY 1, 2",
+		stationNumber)
+	if err != nil {
+		return normals, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var year, month, rrDays int
+		var values [3]sql.NullFloat64
+		if err := rows.Scan(&year, &month, &values[0], &values[1], &rrDays, &values[2]); err != nil {
+			return normals, err
+		}
+		if month < 1 || month > 12 {
+			continue
+		}
+		days := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, stationTZ).Day()
+		if float64(rrDays) < monthMinCoverage*float64(days) {
+			values[1].Valid = false
+		}
+		metrics := [3]*normalValue{&normals[month-1].Tavg, &normals[month-1].RR, &normals[month-1].RHavg}
+		for i, v := range values {
+			if v.Valid {
+				sums[month-1][i] += v.Float64
+				metrics[i].Years++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return normals, err
+	}
+
+	for m := range normals {
+		normals[m].Month = m + 1
+		metrics := [3]*normalValue{&normals[m].Tavg, &normals[m].RR, &normals[m].RHavg}
+		for i, metric := range metrics {
+			if metric.Years >= minYears {
+				mean := sums[m][i] / float64(metric.Years)
+				metric.Value = &mean
+			}
+		}
+	}
+	return normals, nil
+}
+
+// handleNormals returns the 12-month climate normals table for a station.
+func (s *server) handleNormals(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	normals, err := s.monthlyNormals(r.Context(), stationNumber, minYears)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string          `json:"station_number"`
+		MinYears      int             `json:"min_years"`
+		Months        [12]monthNormal `json:"months"`
+	}{stationNumber, minYears, normals})
+}
+
+// climatePeriod is a run of consecutive months, possibly wrapping around the
+// year, that are all arid or all humid.
+type climatePeriod struct {
+	Kind       string `json:"kind"`
+	StartMonth int    `json:"start_month"`
+	EndMonth   int    `json:"end_month"`
+}
+
+// handleWalterLieth returns the data of a Walter-Lieth climate diagram: the
+// monthly normals of mean temperature and precipitation, their annual mean
+// and total, and the arid and humid periods. On the diagram's scale of
+// 10 °C to 20 mm, a month is arid when its precipitation falls below twice
+// its mean temperature. crossings holds the fractional month positions (1 is
+// mid-January, 12.5 the turn of the year) where the two curves intersect.
+// Diagrams of southern hemisphere stations conventionally start in July,
+// given as start_month.
+func (s *server) handleWalterLieth(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	station, err := s.lookupStation(r.Context(), stationNumber)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	normals, err := s.monthlyNormals(r.Context(), stationNumber, minYears)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	type diagramMonth struct {
+		Month         int      `json:"month"`
+		Temperature   *float64 `json:"temperature"`
+		Precipitation *float64 `json:"precipitation"`
+		Years         int      `json:"years"`
+	}
+	months := make([]diagramMonth, 12)
+	complete := true
+	var tempSum, precipSum float64
+	for i, n := range normals {
+		years := n.Tavg.Years
+		if n.RR.Years < years {
+			years = n.RR.Years
+		}
+		months[i] = diagramMonth{Month: n.Month, Temperature: n.Tavg.Value, Precipitation: n.RR.Value, Years: years}
+		if n.Tavg.Value == nil || n.RR.Value == nil {
+			complete = false
+			continue
+		}
+		tempSum += *n.Tavg.Value
+		precipSum += *n.RR.Value
+	}
+
+	result := struct {
+		StationNumber       string          `json:"station_number"`
+		StationName         string          `json:"station_name"`
+		Latitude            float64         `json:"latitude"`
+		Elevation           *float64        `json:"elevation"`
+		MinYears            int             `json:"min_years"`
+		Status              string          `json:"status"`
+		StartMonth          int             `json:"start_month"`
+		AnnualTemperature   *float64        `json:"annual_mean_temperature"`
+		AnnualPrecipitation *float64        `json:"annual_precipitation"`
+		Months              []diagramMonth  `json:"months"`
+		Periods             []climatePeriod `json:"periods"`
+		Crossings           []float64       `json:"crossings"`
+	}{
+		StationNumber: stationNumber,
+		StationName:   station.StationName,
+		Latitude:      station.Latitude,
+		MinYears:      minYears,
+		Status:        "insufficient_history",
+		StartMonth:    1,
+		Months:        months,
+		Periods:       []climatePeriod{},
+		Crossings:     []float64{},
+	}
+	if station.Elevation.Valid {
+		result.Elevation = &station.Elevation.Float64
+	}
+	if station.Latitude < 0 {
+		result.StartMonth = 7
+	}
+
+	// Periods need all twelve months, as they wrap around the year
+	if complete {
+		result.Status = "ok"
+		annualTemp := tempSum / 12
+		result.AnnualTemperature, result.AnnualPrecipitation = &annualTemp, &precipSum
+
+		// The precipitation surplus over twice the temperature is negative in
+		// arid months
+		var surplus [12]float64
+		for i, m := range months {
+			surplus[i] = *m.Precipitation - 2**m.Temperature
+		}
+		result.Periods = climatePeriods(surplus)
+		for i := range surplus {
+			next := surplus[(i+1)%12]
+			if (surplus[i] < 0) != (next < 0) {
+				result.Crossings = append(result.Crossings, float64(i+1)+surplus[i]/(surplus[i]-next))
+			}
+		}
+	}
+
+	writeJSON(w, r, result)
+}
+
+// climatePeriods groups the months into arid and humid runs by the sign of
+// their precipitation surplus. Runs wrapping around the turn of the year are
+// joined, so a dry season from November to February is a single period.
+func climatePeriods(surplus [12]float64) []climatePeriod {
+	kind := func(i int) string {
+		if surplus[i%12] < 0 {
+			return "arid"
+		}
+		return "humid"
+	}
+
+	// Start right after a change of kind, so no run is split in two
+	start := 0
+	for i := 0; i < 12; i++ {
+		if kind(i) != kind(i+11) {
+			start = i
+			break
+		}
+	}
+
+	periods := []climatePeriod{}
+	for i := start; i < start+12; i++ {
+		if len(periods) > 0 && periods[len(periods)-1].Kind == kind(i) {
+			periods[len(periods)-1].EndMonth = i%12 + 1
+			continue
+		}
+		periods = append(periods, climatePeriod{Kind: kind(i), StartMonth: i%12 + 1, EndMonth: i%12 + 1})
+	}
+	return periods
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVar documents one setting, named after the environment variable it is
+// read from, and how to check it is well-formed.
+type envVar struct {
+	Name        string
+	Description string
+
+	// required reports whether the setting must be given; nil means optional
+	required func(settings) bool
+	check    func(string) error
+}
+
+func checkInt(v string) error {
+	if _, err := strconv.Atoi(v); err != nil {
+		return errors.New("must be an integer")
+	}
+	return nil
+}
+
+func checkPositive(v string) error {
+	if n, err := strconv.Atoi(v); err != nil || n < 1 {
+		return errors.New("must be a positive integer")
+	}
+	return nil
+}
+
+func checkNonNegative(v string) error {
+	if n, err := strconv.Atoi(v); err != nil || n < 0 {
+		return errors.New("must be a non-negative integer")
+	}
+	return nil
+}
+
+func checkBool(v string) error {
+	if v != "true" && v != "false" {
+		return errors.New("must be true or false")
+	}
+	return nil
+}
+
+func checkTZ(v string) error {
+	_, err := time.LoadLocation(v)
+	return err
+}
+
+var envVars = []envVar{
+	{Name: "PSQL", Description: "PostgreSQL connection string (or set DB_USER and DB_NAME)",
+		required: func(s settings) bool { return s["DB_USER"] == "" || s["DB_NAME"] == "" }},
+	{Name: "DB_HOST", Description: "database host when PSQL is unset, default localhost"},
+	{Name: "DB_PORT", Description: "database port when PSQL is unset, default 5432", check: checkInt},
+	{Name: "DB_USER", Description: "database user when PSQL is unset"},
+	{Name: "DB_PASSWORD", Description: "database password when PSQL is unset"},
+	{Name: "DB_NAME", Description: "database name when PSQL is unset"},
+	{Name: "DB_SSLMODE", Description: "sslmode when PSQL is unset, default require"},
+	{Name: "DB_CONNECT_ATTEMPTS", Description: "startup connection attempts before giving up, default 10", check: checkInt},
+	{Name: "DB_CONNECT_INTERVAL", Description: "seconds before the first connection retry, doubling up to 30", check: checkInt},
+	{Name: "DB_MAX_OPEN_CONNS", Description: "most open database connections, default 0 for no limit", check: checkNonNegative},
+	{Name: "DB_MAX_IDLE_CONNS", Description: "idle database connections kept for reuse, default 2", check: checkNonNegative},
+	{Name: "DB_CONN_MAX_LIFETIME", Description: "seconds a database connection is reused for, default 0 for no limit", check: checkNonNegative},
+	{Name: "LISTEN_ADDR", Description: "TCP address or unix:/path to listen on, default :8080"},
+	{Name: "STATION_TZ", Description: "time zone of station calendar days, default WIB", check: checkTZ},
+	{Name: "TZ", Description: "fallback for STATION_TZ", check: checkTZ},
+	{Name: "CORS_ORIGINS", Description: "comma-separated origins allowed to call the API from a browser, default * for any",
+		check: func(v string) error { _, err := parseCORSOrigins(v); return err }},
+	{Name: "LOG_FORMAT", Description: "access log format: common (default), combined, json or off", check: checkLogFormat},
+	{Name: "ADMIN_TOKEN", Description: "bearer token for /admin endpoints, which are disabled without it"},
+	{Name: "API_KEYS", Description: "client keys as name:key[:limit per minute[:feature+feature]], comma-separated",
+		check: func(v string) error { _, err := parseAPIKeys(v); return err }},
+	{Name: "API_KEY_REQUIRED", Description: "require an X-API-Key on every endpoint but the index, /healthz and /readyz", check: checkBool},
+	{Name: "DATA_FRESHNESS_HOURS", Description: "hours the newest observation may be old before /readyz fails, default 48, 0 to skip", check: checkInt},
+	{Name: "CACHE_MAX_AGE", Description: "max-age in seconds for responses covering past days", check: checkInt},
+	{Name: "MAX_TYPES", Description: "types allowed per /input/data request, default all", check: checkInt},
+	{Name: "AGGREGATE_CACHE_SIZE", Description: "aggregate responses kept in memory, default 256, 0 to disable caching", check: checkInt},
+	{Name: "CACHE_MEMORY_BYTES", Description: "memory budget shared by the in-memory caches, default 64 MiB", check: checkInt},
+	{Name: "CACHE_STALE_IF_ERROR", Description: "answer a failed aggregate request with its expired cached response, marked X-Cache: stale", check: checkBool},
+	{Name: "AGGREGATE_CACHE_TTL", Description: "seconds a cached aggregate response stays fresh, default 300", check: checkInt},
+	{Name: "MAX_BATCH_RECORDS", Description: "records allowed per /input/data/batch request, default 1000", check: checkInt},
+	{Name: "REQUEST_TIMEOUT", Description: "total seconds a request may take, default 60, 0 for no limit", check: checkInt},
+	{Name: "MAX_RESPONSE_BYTES", Description: "largest JSON response in bytes, default 64 MiB, 0 for no limit", check: checkInt},
+	{Name: "MAX_DATE_RANGES", Description: "date ranges allowed per /input/data request", check: checkInt},
+	{Name: "MAX_CONCURRENT", Description: "in-flight request cap, 0 disables", check: checkInt},
+	{Name: "DISABLED_ENDPOINTS", Description: "comma-separated features to turn off, e.g. export,climatology", check: checkFeatureList},
+	{Name: "READ_ONLY", Description: "start in read-only maintenance mode", check: checkBool},
+	{Name: "MIGRATE_ON_START", Description: "apply schema migrations on startup", check: checkBool},
+	{Name: "EXPORT_DIR", Description: "directory for generated exports"},
+	{Name: "EXPORT_TTL", Description: "seconds a finished export is kept, default 86400; S3 exports last S3_PRESIGN_TTL", check: checkPositive},
+	{Name: "S3_BUCKET", Description: "bucket to upload exports to; exports are served locally without it"},
+	{Name: "S3_ENDPOINT", Description: "S3-compatible endpoint URL, default AWS"},
+	{Name: "S3_REGION", Description: "S3 region, default us-east-1"},
+	{Name: "S3_ACCESS_KEY", Description: "S3 access key",
+		required: func(s settings) bool { return s["S3_BUCKET"] != "" }},
+	{Name: "S3_SECRET_KEY", Description: "S3 secret key",
+		required: func(s settings) bool { return s["S3_BUCKET"] != "" }},
+	{Name: "S3_PRESIGN_TTL", Description: "lifetime in seconds of export download URLs, and of the exports in S3", check: checkInt},
+	{Name: "STREAM_POLL_SECONDS", Description: "seconds between checks for new observations on /weather/stream, default 60", check: checkPositive},
+	{Name: "CSV_FLUSH_ROWS", Description: "rows between flushes of streamed CSV, 0 flushes only at the end", check: checkInt},
+	{Name: "NORMALS_MIN_YEARS", Description: "years of data a monthly climate normal needs", check: checkInt},
+	{Name: "RAIN_CATEGORY_THRESHOLDS", Description: "lower mm bounds of the rain categories",
+		check: func(v string) error { _, err := rainCategories(v); return err }},
+}
+
+// settings holds the raw value of each setting by its environment variable
+// name, from the -config file overlaid with the environment.
+type settings map[string]string
+
+// loadSettings reads the settings from the environment, on top of those in
+// the YAML or JSON file at path when one is given. The file holds the
+// settings by their lowercase names, e.g. listen_addr or max_concurrent;
+// comma-separated lists such as disabled_endpoints may be written as
+// sequences too.
+func loadSettings(path string) (settings, error) {
+	s := settings{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// JSON is a subset of YAML, so one decoder reads both
+		var file map[string]interface{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		known := map[string]bool{}
+		for _, v := range envVars {
+			known[v.Name] = true
+		}
+		for key, value := range file {
+			name := strings.ToUpper(key)
+			if !known[name] {
+				return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+			}
+			s[name] = settingValue(value)
+		}
+	}
+
+	for _, v := range envVars {
+		if value := os.Getenv(v.Name); value != "" {
+			s[v.Name] = value
+		}
+	}
+	return s, nil
+}
+
+// settingValue renders a value decoded from the config file in the form the
+// environment variable would hold it.
+func settingValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, part := range v {
+			parts[i] = settingValue(part)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+func (s settings) str(name, def string) string {
+	if v := s[name]; v != "" {
+		return v
+	}
+	return def
+}
+
+func (s settings) int(name string, def int) int {
+	if v, err := strconv.Atoi(s[name]); err == nil {
+		return v
+	}
+	return def
+}
+
+func (s settings) seconds(name string, def int) time.Duration {
+	return time.Duration(s.int(name, def)) * time.Second
+}
+
+// Config is the parsed configuration, see envVars for what each setting
+// does. It is built once at startup, defaults filled in.
+type Config struct {
+	PSQL              string
+	DBHost            string
+	DBPort            string
+	DBUser            string
+	DBPassword        string
+	DBName            string
+	DBSSLMode         string
+	DBConnectAttempts int
+	DBConnectInterval time.Duration
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	ListenAddr        string
+	StationTZ         string
+	LogFormat         string
+	CORSOrigins       []string
+	MaxConcurrent     int
+	RequestTimeout    time.Duration
+	ReadOnly          bool
+	MigrateOnStart    bool
+	DisabledEndpoints map[string]bool
+
+	AdminToken     string
+	APIKeys        []*apiKey
+	APIKeyRequired bool
+
+	MaxTypes         int
+	MaxDateRanges    int
+	MaxBatchRecords  int
+	MaxResponseBytes int
+
+	CacheMaxAge        int
+	AggregateCacheSize int
+	AggregateCacheTTL  time.Duration
+	CacheMemoryBytes   int
+	CacheStaleIfError  bool
+
+	ExportDir    string
+	ExportTTL    time.Duration
+	S3Bucket     string
+	S3Endpoint   string
+	S3Region     string
+	S3AccessKey  string
+	S3SecretKey  string
+	S3PresignTTL time.Duration
+	CSVFlushRows int
+	StreamPoll   time.Duration
+
+	NormalsMinYears int
+	RainCategories  []rainCategory
+	DataFreshness   time.Duration
+}
+
+// config is the server's configuration. It holds the defaults until main
+// loads the settings.
+var config Config
+
+func init() {
+	config = newConfig(settings{})
+}
+
+// newConfig parses validated settings, see validateSettings.
+func newConfig(s settings) Config {
+	c := Config{
+		PSQL:              s["PSQL"],
+		DBHost:            s.str("DB_HOST", "localhost"),
+		DBPort:            s.str("DB_PORT", "5432"),
+		DBUser:            s["DB_USER"],
+		DBPassword:        s["DB_PASSWORD"],
+		DBName:            s["DB_NAME"],
+		DBSSLMode:         s.str("DB_SSLMODE", "require"),
+		DBConnectAttempts: s.int("DB_CONNECT_ATTEMPTS", 10),
+		DBConnectInterval: s.seconds("DB_CONNECT_INTERVAL", 1),
+		DBMaxOpenConns:    s.int("DB_MAX_OPEN_CONNS", 0),
+		DBMaxIdleConns:    s.int("DB_MAX_IDLE_CONNS", 2),
+		DBConnMaxLifetime: s.seconds("DB_CONN_MAX_LIFETIME", 0),
+
+		ListenAddr:        s.str("LISTEN_ADDR", ":8080"),
+		StationTZ:         s.str("STATION_TZ", s["TZ"]),
+		LogFormat:         s.str("LOG_FORMAT", "common"),
+		MaxConcurrent:     s.int("MAX_CONCURRENT", 100),
+		RequestTimeout:    s.seconds("REQUEST_TIMEOUT", 60),
+		ReadOnly:          s["READ_ONLY"] == "true",
+		MigrateOnStart:    s["MIGRATE_ON_START"] == "true",
+		DisabledEndpoints: parseFeatureList(s["DISABLED_ENDPOINTS"]),
+
+		AdminToken:     s["ADMIN_TOKEN"],
+		APIKeyRequired: s["API_KEY_REQUIRED"] == "true",
+
+		MaxTypes:         s.int("MAX_TYPES", len(weatherColumns)+len(derivedFields)),
+		MaxDateRanges:    s.int("MAX_DATE_RANGES", 10),
+		MaxBatchRecords:  s.int("MAX_BATCH_RECORDS", 1000),
+		MaxResponseBytes: s.int("MAX_RESPONSE_BYTES", 64<<20),
+
+		CacheMaxAge:        s.int("CACHE_MAX_AGE", 86400),
+		AggregateCacheSize: s.int("AGGREGATE_CACHE_SIZE", 256),
+		AggregateCacheTTL:  s.seconds("AGGREGATE_CACHE_TTL", 300),
+		CacheMemoryBytes:   s.int("CACHE_MEMORY_BYTES", 64<<20),
+		CacheStaleIfError:  s["CACHE_STALE_IF_ERROR"] == "true",
+
+		ExportDir:    s.str("EXPORT_DIR", filepath.Join(os.TempDir(), "hujan-exports")),
+		ExportTTL:    s.seconds("EXPORT_TTL", 86400),
+		S3Bucket:     s["S3_BUCKET"],
+		S3Endpoint:   s.str("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:     s.str("S3_REGION", "us-east-1"),
+		S3AccessKey:  s["S3_ACCESS_KEY"],
+		S3SecretKey:  s["S3_SECRET_KEY"],
+		S3PresignTTL: s.seconds("S3_PRESIGN_TTL", 3600),
+		CSVFlushRows: s.int("CSV_FLUSH_ROWS", 500),
+		StreamPoll:   s.seconds("STREAM_POLL_SECONDS", 60),
+
+		NormalsMinYears: s.int("NORMALS_MIN_YEARS", 10),
+		DataFreshness:   time.Duration(s.int("DATA_FRESHNESS_HOURS", 48)) * time.Hour,
+	}
+	// Malformed values were reported by validateSettings
+	c.APIKeys, _ = parseAPIKeys(s["API_KEYS"])
+	c.RainCategories, _ = rainCategories(s["RAIN_CATEGORY_THRESHOLDS"])
+	c.CORSOrigins, _ = parseCORSOrigins(s["CORS_ORIGINS"])
+	return c
+}
+
+// validateSettings checks every known setting. When anything is missing or
+// malformed it returns a report listing the required and optional settings
+// with their status.
+func validateSettings(s settings) (string, bool) {
+	var required, optional strings.Builder
+	ok := true
+	for _, v := range envVars {
+		value := s[v.Name]
+		isRequired := v.required != nil && v.required(s)
+
+		status := "ok"
+		switch {
+		case value == "":
+			status = "not set"
+			if isRequired {
+				status = "MISSING"
+				ok = false
+			}
+		case v.check != nil:
+			if err := v.check(value); err != nil {
+				status = "INVALID: " + err.Error()
+				ok = false
+			}
+		}
+
+		line := fmt.Sprintf("  %-26s %-10s %s\n", v.Name, status, v.Description)
+		if isRequired {
+			required.WriteString(line)
+		} else {
+			optional.WriteString(line)
+		}
+	}
+	if ok {
+		return "", true
+	}
+	return "Invalid configuration.\nRequired:\n" + required.String() + "Optional:\n" + optional.String(), false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// correlationMinDays is the number of days with both values a pair needs for
+// its coefficient to be reported.
+const correlationMinDays = 10
+
+// handleCorrelationMatrix computes the Pearson correlation between every pair
+// of a station's columns over a date range, together with the number of days
+// it rests on. Each pair uses the days on which both of its columns have a
+// value, so a gappy column only thins out its own pairs. type restricts the
+// columns; by default all of them take part. The wind directions never do,
+// as they are circular and do not correlate linearly.
+func (s *server) handleCorrelationMatrix(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	var columns []string
+	if v := values.Get("type"); v != "" {
+		seen := map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			if !isWeatherColumn(t) {
+				httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(t)+".", http.StatusBadRequest)
+				return
+			}
+			if err := linearColumn(t); err != nil {
+				httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !seen[t] {
+				seen[t] = true
+				columns = append(columns, t)
+			}
+		}
+		if len(columns) < 2 {
+			httpError(w, r, "Invalid request. type must list at least two columns.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, c := range weatherColumns {
+			if !c.Circular {
+				columns = append(columns, c.Key)
+			}
+		}
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// CORR and the pair counts skip the days missing either value, which is
+	// the pairwise deletion wanted, so one pass computes the whole triangle
+	var selects []string
+	for i, a := range columns {
+		for _, b := range columns[i:] {
+			selects = append(selects,
+				"CORR(\""+a+"\", \""+b+"\")",
+				"COUNT(*) FILTER (WHERE \""+a+"\" IS NOT NULL AND \""+b+"\" IS NOT NULL)")
+		}
+	}
+	results := make([]interface{}, len(selects))
+	coefficients := make([]sql.NullFloat64, len(selects)/2)
+	counts := make([]int, len(selects)/2)
+	for i := range coefficients {
+		results[2*i], results[2*i+1] = &coefficients[i], &counts[i]
+	}
+	err = s.db.QueryRowContext(r.Context(), "SELECT "+strings.Join(selects, ", ")+" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")).Scan(results...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Mirror the triangle into full matrices
+	matrix := make([][]*float64, len(columns))
+	days := make([][]int, len(columns))
+	for i := range columns {
+		matrix[i], days[i] = make([]*float64, len(columns)), make([]int, len(columns))
+	}
+	k := 0
+	for i := range columns {
+		for j := i; j < len(columns); j++ {
+			days[i][j], days[j][i] = counts[k], counts[k]
+			if coefficients[k].Valid && counts[k] >= correlationMinDays {
+				coefficient := coefficients[k].Float64
+				matrix[i][j], matrix[j][i] = &coefficient, &coefficient
+			}
+			k++
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string       `json:"station_number"`
+		StartDate     string       `json:"start_date"`
+		EndDate       string       `json:"end_date"`
+		MinDays       int          `json:"min_days"`
+		Columns       []string     `json:"columns"`
+		Matrix        [][]*float64 `json:"matrix"`
+		Days          [][]int      `json:"days"`
+	}{stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), correlationMinDays, columns, matrix, days})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxCoverageYears caps the span of a coverage matrix, which has a column per
+// month for every station.
+const maxCoverageYears = 50
+
+// handleCoverage returns a station-by-month matrix of Weather record counts
+// over a date range, for data availability heatmaps. Every station appears,
+// including those without any records in the range, unless narrowed down
+// with include or exclude. The range spans at most maxCoverageYears.
+func (s *server) handleCoverage(w http.ResponseWriter, r *http.Request) {
+	startDate, endDate, err := parseDateRange(r.URL.Query().Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if endDate.After(startDate.AddDate(maxCoverageYears, 0, -1)) {
+		httpError(w, r, "Invalid request. dateRange must span at most "+strconv.Itoa(maxCoverageYears)+" years.", http.StatusBadRequest)
+		return
+	}
+
+	// The matrix columns are every month touched by the range
+	months := []string{}
+	column := map[string]int{}
+	for m := time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, stationTZ); !m.After(endDate); m = m.AddDate(0, 1, 0) {
+		column[m.Format("2006-01")] = len(months)
+		months = append(months, m.Format("2006-01"))
+	}
+
+	filter, args, err := stationFilter(r.URL.Query(), "s.station_number", []interface{}{startDate.Format("2006-01-02"), endDate.Format("2006-01-02")})
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT s.station_number, s.station_name, SUBSTRING(w.\"Tanggal\", 1, 7), COUNT(w.id) FROM \"Station\" s LEFT JOIN \"Weather\" w ON w.station_number = s.station_number AND w.\"Tanggal\" BETWEEN $1 AND $2 WHERE "+filter+" GROUP BY 1, 2, 3 ORDER BY 1",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type stationCoverage struct {
+		StationNumber int    `json:"station_number"`
+		StationName   string `json:"station_name"`
+		Counts        []int  `json:"counts"`
+	}
+	stations := []*stationCoverage{}
+	for rows.Next() {
+		var stationNumber int
+		var stationName string
+		var month sql.NullString
+		var count int
+		if err := rows.Scan(&stationNumber, &stationName, &month, &count); err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		// Rows are ordered by station, so each station's months arrive together
+		if len(stations) == 0 || stations[len(stations)-1].StationNumber != stationNumber {
+			stations = append(stations, &stationCoverage{
+				StationNumber: stationNumber,
+				StationName:   stationName,
+				Counts:        make([]int, len(months)),
+			})
+		}
+		// A NULL month is the LEFT JOIN row of a station without records
+		if i, ok := column[month.String]; month.Valid && ok {
+			stations[len(stations)-1].Counts[i] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		Months   []string           `json:"months"`
+		Stations []*stationCoverage `json:"stations"`
+	}{months, stations})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// departureDay is one day of a cumulative rainfall departure curve.
+type departureDay struct {
+	Date       string   `json:"date"`
+	RR         *float64 `json:"rr"`
+	Normal     *float64 `json:"normal"`
+	Departure  *float64 `json:"departure"`
+	Cumulative float64  `json:"cumulative"`
+}
+
+// handleCumulativeDeparture returns, for each day of a date range, the
+// rainfall minus its normal and the running sum of those departures, whose
+// slope turns where a wet regime gives way to a dry one. A day's normal is
+// its month's rr normal, see /climatology/normals, spread evenly over the
+// month's days. Days without a reading or a normal add nothing, so the
+// cumulative value carries forward across them.
+func (s *server) handleCumulativeDeparture(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	normals, err := s.monthlyNormals(r.Context(), stationNumber, minYears)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", rr FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND rr IS NOT NULL",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	rainfall := map[string]float64{}
+	for rows.Next() {
+		var tanggal string
+		var rr float64
+		if err := rows.Scan(&tanggal, &rr); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		rainfall[tanggal] = rr
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Every calendar day gets a point, so the curve has an even time axis
+	status := "ok"
+	days := []departureDay{}
+	cumulative := 0.0
+	for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		d := departureDay{Date: day.Format("2006-01-02")}
+		if monthly := normals[day.Month()-1].RR.Value; monthly != nil {
+			monthDays := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, stationTZ).AddDate(0, 1, -1).Day()
+			normal := *monthly / float64(monthDays)
+			d.Normal = &normal
+		} else {
+			status = "insufficient_history"
+		}
+		if rr, ok := rainfall[d.Date]; ok {
+			d.RR = &rr
+			if d.Normal != nil {
+				departure := rr - *d.Normal
+				d.Departure = &departure
+				cumulative += departure
+			}
+		}
+		d.Cumulative = cumulative
+		days = append(days, d)
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string         `json:"station_number"`
+		MinYears      int            `json:"min_years"`
+		Status        string         `json:"status"`
+		Total         float64        `json:"total_departure"`
+		Days          []departureDay `json:"days"`
+	}{stationNumber, minYears, status, cumulative, days})
+}
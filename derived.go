@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// derivedField is a value computed from stored columns rather than read
+// directly. It is requested by key through the same type parameter as the
+// stored columns.
+type derivedField struct {
+	weatherColumn
+	Formula string   `json:"formula"`
+	Inputs  []string `json:"inputs"`
+
+	// Categories lists the classes of a categorical field, whose values are
+	// their labels rather than numbers
+	Categories []fieldCategory `json:"categories,omitempty"`
+
+	// compute returns nil when the result is undefined
+	compute func(inputs []float64) interface{}
+}
+
+// fieldCategory is one class of a categorical derived field, covering
+// values from Min up to but excluding Max. A nil bound is open.
+type fieldCategory struct {
+	Label string   `json:"label"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+}
+
+// classify returns the label of the category v falls into.
+func classify(categories []fieldCategory, v float64) interface{} {
+	for _, c := range categories {
+		if (c.Min == nil || v >= *c.Min) && (c.Max == nil || v < *c.Max) {
+			return c.Label
+		}
+	}
+	return nil
+}
+
+func bound(v float64) *float64 { return &v }
+
+// thiCategories are the comfort classes of the Temperature-Humidity Index,
+// after Thom's discomfort scale: below 24 fewer than half of people feel
+// discomfort, from 29 heat stress becomes severe.
+var thiCategories = []fieldCategory{
+	{Label: "comfortable", Max: bound(24)},
+	{Label: "caution", Min: bound(24), Max: bound(29)},
+	{Label: "danger", Min: bound(29)},
+}
+
+// thi is Thom's Temperature-Humidity Index from a temperature in °C and a
+// relative humidity in %.
+func thi(t, rh float64) float64 {
+	return t - 0.55*(1-rh/100)*(t-14.5)
+}
+
+var derivedFields = []derivedField{
+	{
+		weatherColumn: weatherColumn{Key: "vpd", Name: "Vapor Pressure Deficit", Unit: "kPa", Description: "Saturation vapor pressure at tavg minus the actual vapor pressure implied by rh_avg."},
+		Formula:       "es = 0.6108 * exp(17.27 * tavg / (tavg + 237.3)); vpd = es * (1 - rh_avg / 100)",
+		Inputs:        []string{"tavg", "rh_avg"},
+		compute: func(in []float64) interface{} {
+			return saturationVaporPressure(in[0]) * (1 - in[1]/100)
+		},
+	},
+	{
+		weatherColumn: weatherColumn{Key: "dewpoint", Name: "Dewpoint", Unit: "°C", Description: "Temperature at which the air at tavg and rh_avg would be saturated."},
+		Formula:       "g = ln(rh_avg / 100) + 17.27 * tavg / (tavg + 237.3); dewpoint = 237.3 * g / (17.27 - g)",
+		Inputs:        []string{"tavg", "rh_avg"},
+		compute: func(in []float64) interface{} {
+			// Dry air has no dewpoint
+			if in[1] <= 0 {
+				return nil
+			}
+			g := math.Log(in[1]/100) + 17.27*in[0]/(in[0]+237.3)
+			return 237.3 * g / (17.27 - g)
+		},
+	},
+	{
+		weatherColumn: weatherColumn{Key: "thi", Name: "Temperature-Humidity Index", Unit: "°C", Description: "Thom's discomfort index of how hot tavg feels at humidity rh_avg."},
+		Formula:       "thi = tavg - 0.55 * (1 - rh_avg / 100) * (tavg - 14.5)",
+		Inputs:        []string{"tavg", "rh_avg"},
+		compute: func(in []float64) interface{} {
+			return thi(in[0], in[1])
+		},
+	},
+	{
+		weatherColumn: weatherColumn{Key: "thi_comfort", Name: "Comfort", Description: "Comfort class of the Temperature-Humidity Index: comfortable, caution or danger."},
+		Formula:       "thi < 24: comfortable; 24 <= thi < 29: caution; thi >= 29: danger",
+		Inputs:        []string{"tavg", "rh_avg"},
+		Categories:    thiCategories,
+		compute: func(in []float64) interface{} {
+			return classify(thiCategories, thi(in[0], in[1]))
+		},
+	},
+}
+
+// saturationVaporPressure returns the saturation vapor pressure in kPa at a
+// temperature in °C, per the Tetens equation.
+func saturationVaporPressure(t float64) float64 {
+	return 0.6108 * math.Exp(17.27*t/(t+237.3))
+}
+
+func lookupDerived(name string) (derivedField, bool) {
+	for _, f := range derivedFields {
+		if f.Key == name {
+			return f, true
+		}
+	}
+	return derivedField{}, false
+}
+
+// resolveTypes splits the requested types into the stored columns to select
+// and the derived fields to compute. Inputs of derived fields that were not
+// requested themselves are selected too and listed in hidden, to be dropped
+// once the derived values are filled in.
+func resolveTypes(types []string) (columns []string, derived []derivedField, hidden []string, err error) {
+	selected := map[string]bool{}
+	for _, t := range types {
+		if isWeatherColumn(t) {
+			if !selected[t] {
+				columns = append(columns, t)
+				selected[t] = true
+			}
+			continue
+		}
+		f, ok := lookupDerived(t)
+		if !ok {
+			return nil, nil, nil, errors.New("Unknown type " + strconv.Quote(t) + ".")
+		}
+		derived = append(derived, f)
+	}
+
+	for _, f := range derived {
+		for _, input := range f.Inputs {
+			if !selected[input] {
+				columns = append(columns, input)
+				hidden = append(hidden, input)
+				selected[input] = true
+			}
+		}
+	}
+	return columns, derived, hidden, nil
+}
+
+// applyDerived fills in the derived fields of each row and removes the hidden
+// input columns.
+func applyDerived(rows []map[string]interface{}, derived []derivedField, hidden []string) {
+	for _, row := range rows {
+		applyDerivedRow(row, derived, hidden)
+	}
+}
+
+func applyDerivedRow(row map[string]interface{}, derived []derivedField, hidden []string) {
+	for _, f := range derived {
+		inputs := make([]float64, len(f.Inputs))
+		var value interface{}
+		complete := true
+		for i, input := range f.Inputs {
+			v, ok := toFloat(row[input])
+			if !ok {
+				complete = false
+				break
+			}
+			inputs[i] = v
+		}
+		if complete {
+			value = f.compute(inputs)
+		}
+		row[f.Key] = value
+	}
+	for _, input := range hidden {
+		delete(row, input)
+	}
+}
+
+// toFloat converts a scanned numeric column to a float64. NULL and
+// non-numeric values report false.
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
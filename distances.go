@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxDistanceStations caps the stations of a distance matrix, whose size
+// grows with their square.
+const maxDistanceStations = 200
+
+// handleDistances returns the haversine distances in km between the stations
+// listed in stations, comma-separated, or between all stations when none
+// are. distances_km[i][j] is the distance from stations[i] to stations[j].
+// Listing more than maxDistanceStations is rejected; without a list the
+// first maxDistanceStations by number are used and truncated is set.
+func (s *server) handleDistances(w http.ResponseWriter, r *http.Request) {
+	var numbers []interface{}
+	var placeholders []string
+	if v := r.URL.Query().Get("stations"); v != "" {
+		seen := map[int]bool{}
+		for _, n := range strings.Split(v, ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(n))
+			if err != nil {
+				httpError(w, r, "Invalid request. stations must be a comma-separated list of station numbers.", http.StatusBadRequest)
+				return
+			}
+			if !seen[number] {
+				seen[number] = true
+				numbers = append(numbers, number)
+				placeholders = append(placeholders, "$"+strconv.Itoa(len(numbers)))
+			}
+		}
+		if len(numbers) > maxDistanceStations {
+			httpError(w, r, "Invalid request. At most "+strconv.Itoa(maxDistanceStations)+" stations can be compared at once.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// One more than the cap tells whether the full listing was truncated
+	query := "SELECT station_number, station_name, latitude, longitude FROM \"Station\" ORDER BY station_number LIMIT " + strconv.Itoa(maxDistanceStations+1)
+	if len(numbers) > 0 {
+		query = "SELECT station_number, station_name, latitude, longitude FROM \"Station\" WHERE station_number IN (" + strings.Join(placeholders, ", ") + ") ORDER BY station_number"
+	}
+	rows, err := s.db.QueryContext(r.Context(), query, numbers...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type stationPoint struct {
+		StationNumber int     `json:"station_number"`
+		StationName   string  `json:"station_name"`
+		Latitude      float64 `json:"latitude"`
+		Longitude     float64 `json:"longitude"`
+	}
+	stations := []stationPoint{}
+	for rows.Next() {
+		var st stationPoint
+		if err := rows.Scan(&st.StationNumber, &st.StationName, &st.Latitude, &st.Longitude); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		stations = append(stations, st)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if len(numbers) > 0 && len(stations) < len(numbers) {
+		found := map[int]bool{}
+		for _, st := range stations {
+			found[st.StationNumber] = true
+		}
+		var missing []string
+		for _, n := range numbers {
+			if !found[n.(int)] {
+				missing = append(missing, strconv.Itoa(n.(int)))
+			}
+		}
+		httpError(w, r, "Station not found: "+strings.Join(missing, ", ")+".", http.StatusNotFound)
+		return
+	}
+
+	truncated := len(stations) > maxDistanceStations
+	if truncated {
+		stations = stations[:maxDistanceStations]
+	}
+
+	distances := make([][]float64, len(stations))
+	for i, a := range stations {
+		distances[i] = make([]float64, len(stations))
+		for j, b := range stations[:i] {
+			d := haversineKm(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+			distances[i][j], distances[j][i] = d, d
+		}
+	}
+
+	writeJSON(w, r, struct {
+		Stations    []stationPoint `json:"stations"`
+		DistancesKm [][]float64    `json:"distances_km"`
+		Truncated   bool           `json:"truncated"`
+	}{stations, distances, truncated})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// lttb reduces a series to n points by largest-triangle-three-buckets: the
+// first and last points are kept, and of each of the n-2 buckets in between
+// the point forming the largest triangle with the point kept before it and
+// the average of the next bucket. Unlike averaging, this keeps the peaks a
+// chart would show. Points without a numeric value are left out.
+func lttb(points []seriesPoint, n int) []seriesPoint {
+	var xs, ys []float64
+	var kept []seriesPoint
+	for i, p := range points {
+		y, ok := toFloat(p.Value)
+		if !ok {
+			continue
+		}
+		x := float64(i)
+		if tanggal, ok := p.Tanggal.(string); ok {
+			if day, err := time.Parse("2006-01-02", tanggal); err == nil {
+				x = float64(day.Unix() / 86400)
+			}
+		}
+		xs, ys = append(xs, x), append(ys, y)
+		kept = append(kept, p)
+	}
+	if n >= len(kept) {
+		return kept
+	}
+
+	sampled := []seriesPoint{kept[0]}
+	every := float64(len(kept)-2) / float64(n-2)
+	a := 0
+	for i := 0; i < n-2; i++ {
+		// The average of the next bucket, or the last point for the final one
+		next, nextEnd := int(float64(i+1)*every)+1, int(float64(i+2)*every)+1
+		if nextEnd > len(kept) {
+			nextEnd = len(kept)
+		}
+		var avgX, avgY float64
+		for j := next; j < nextEnd; j++ {
+			avgX += xs[j]
+			avgY += ys[j]
+		}
+		avgX /= float64(nextEnd - next)
+		avgY /= float64(nextEnd - next)
+
+		best, bestArea := -1, -1.0
+		for j := int(float64(i)*every) + 1; j < next; j++ {
+			area := math.Abs((xs[a]-avgX)*(ys[j]-ys[a]) - (xs[a]-xs[j])*(avgY-ys[a]))
+			if area > bestArea {
+				best, bestArea = j, area
+			}
+		}
+		sampled = append(sampled, kept[best])
+		a = best
+	}
+	return append(sampled, kept[len(kept)-1])
+}
+
+// strideSample reduces a series to n evenly spaced points, for categorical
+// series that have no shape to preserve.
+func strideSample(points []seriesPoint, n int) []seriesPoint {
+	if n >= len(points) {
+		return points
+	}
+	sampled := make([]seriesPoint, n)
+	for i := range sampled {
+		sampled[i] = points[i*(len(points)-1)/(n-1)]
+	}
+	return sampled
+}
+
+// meanBuckets reduces rows to at most n by splitting them into n runs of
+// consecutive rows and averaging each type over every run. A run's row is
+// dated by its first day; categorical fields take their most frequent label,
+// and the quality flag is dropped.
+func meanBuckets(rows []map[string]interface{}, types []string, n int) []map[string]interface{} {
+	if n >= len(rows) {
+		return rows
+	}
+	reduced := make([]map[string]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		bucket := rows[i*len(rows)/n : (i+1)*len(rows)/n]
+		row := map[string]interface{}{dateColumn.Key: bucket[0][dateColumn.Key]}
+		for _, t := range types {
+			if isCategorical(t) {
+				row[t] = mostFrequent(bucket, t)
+				continue
+			}
+			var sum float64
+			var count int
+			for _, r := range bucket {
+				if v, ok := toFloat(r[t]); ok {
+					sum += v
+					count++
+				}
+			}
+			row[t] = nil
+			if count > 0 {
+				row[t] = sum / float64(count)
+			}
+		}
+		reduced = append(reduced, row)
+	}
+	return reduced
+}
+
+// mostFrequent returns the most frequent non-NULL value of column among
+// rows, the earliest one on ties.
+func mostFrequent(rows []map[string]interface{}, column string) interface{} {
+	counts := map[interface{}]int{}
+	var best interface{}
+	for _, r := range rows {
+		v := r[column]
+		if v == nil {
+			continue
+		}
+		counts[v]++
+		if best == nil || counts[v] > counts[best] {
+			best = v
+		}
+	}
+	return best
+}
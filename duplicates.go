@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// parseStationRange reads the stationNumber and dateRange parameters shared
+// by the duplicate endpoints, answering 400 itself when either is invalid.
+func parseStationRange(w http.ResponseWriter, r *http.Request) (string, dateRange, bool) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return "", dateRange{}, false
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return "", dateRange{}, false
+	}
+	return stationNumber, dateRange{Start: startDate, End: endDate}, true
+}
+
+// handleDuplicates lists the days within a range for which a station has
+// more than one Weather row, as left behind by double ingestion.
+func (s *server) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	stationNumber, dr, ok := parseStationRange(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", COUNT(*), MIN(id) FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 GROUP BY station_number, \"Tanggal\" HAVING COUNT(*) > 1 ORDER BY \"Tanggal\"",
+		stationNumber, dr.Start.Format("2006-01-02"), dr.End.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type duplicate struct {
+		Date   string `json:"date"`
+		Count  int    `json:"count"`
+		KeepID int    `json:"keep_id"`
+	}
+	duplicates := []duplicate{}
+	extra := 0
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.Date, &d.Count, &d.KeepID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		extra += d.Count - 1
+		duplicates = append(duplicates, d)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string      `json:"station_number"`
+		Days          int         `json:"days"`
+		ExtraRows     int         `json:"extra_rows"`
+		Duplicates    []duplicate `json:"duplicates"`
+	}{stationNumber, len(duplicates), extra, duplicates})
+}
+
+// handleDedup deletes the duplicate rows /weather/duplicates reports,
+// keeping the row with the lowest id of each day.
+func (s *server) handleDedup(w http.ResponseWriter, r *http.Request) {
+	stationNumber, dr, ok := parseStationRange(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := s.db.ExecContext(r.Context(), "DELETE FROM \"Weather\" w USING \"Weather\" keep WHERE w.station_number = keep.station_number AND w.\"Tanggal\" = keep.\"Tanggal\" AND w.id > keep.id AND w.station_number = $1 AND w.\"Tanggal\" BETWEEN $2 AND $3",
+		stationNumber, dr.Start.Format("2006-01-02"), dr.End.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if deleted > 0 {
+		s.cache.invalidateStation(stationNumber)
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string `json:"station_number"`
+		Deleted       int64  `json:"deleted"`
+	}{stationNumber, deleted})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// erosivityYear is the Modified Fournier Index of one complete year and the
+// R-factor it implies.
+type erosivityYear struct {
+	Year    int     `json:"year"`
+	Annual  float64 `json:"annual_total"`
+	MFI     float64 `json:"mfi"`
+	RFactor float64 `json:"r_factor"`
+}
+
+// fournierRFactor estimates the RUSLE rainfall erosivity factor in
+// MJ mm ha⁻¹ h⁻¹ yr⁻¹ from a Modified Fournier Index in mm, by the
+// regressions of Renard and Freimund (1994).
+func fournierRFactor(mfi float64) float64 {
+	if mfi < 55 {
+		return 0.07397 * math.Pow(mfi, 1.847)
+	}
+	return 95.77 - 6.081*mfi + 0.4770*mfi*mfi
+}
+
+// handleErosivity estimates a station's rainfall erosivity for soil erosion
+// modelling from its monthly rainfall totals. Each year with all twelve
+// months on record, each with rr on at least 80% of its days, gets the
+// Modified Fournier Index, the sum of the squared monthly totals over the
+// annual total, and the R-factor is estimated from the mean index over
+// those years. Fewer than minYears such years give no estimate.
+func (s *server) handleErosivity(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	months, totals, _, err := s.monthlyRainfall(r.Context(), stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// The months start on a January, so every twelve make a calendar year
+	years := []erosivityYear{}
+	for i := 0; i+12 <= len(totals); i += 12 {
+		var annual, squares float64
+		complete := true
+		for _, p := range totals[i : i+12] {
+			if math.IsNaN(p) {
+				complete = false
+				break
+			}
+			annual += p
+			squares += p * p
+		}
+		if !complete || annual <= 0 {
+			continue
+		}
+		mfi := squares / annual
+		years = append(years, erosivityYear{Year: months[i].Year(), Annual: annual, MFI: mfi, RFactor: fournierRFactor(mfi)})
+	}
+
+	result := struct {
+		StationNumber string          `json:"station_number"`
+		MinYears      int             `json:"min_years"`
+		Status        string          `json:"status"`
+		YearsUsed     int             `json:"years_used"`
+		MFI           *float64        `json:"mfi"`
+		RFactor       *float64        `json:"r_factor"`
+		Unit          string          `json:"r_factor_unit"`
+		Years         []erosivityYear `json:"years"`
+	}{
+		StationNumber: stationNumber,
+		MinYears:      minYears,
+		Status:        "insufficient_history",
+		YearsUsed:     len(years),
+		Unit:          "MJ mm ha-1 h-1 yr-1",
+		Years:         years,
+	}
+	if len(years) >= minYears {
+		mfi := 0.0
+		for _, y := range years {
+			mfi += y.MFI
+		}
+		mfi /= float64(len(years))
+		rFactor := fournierRFactor(mfi)
+		result.Status, result.MFI, result.RFactor = "ok", &mfi, &rFactor
+	}
+
+	writeJSON(w, r, result)
+}
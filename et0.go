@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// extraterrestrialRadiation returns Ra in MJ/m²/day and the sunset hour angle
+// for a latitude in degrees on the given day, per FAO-56 equations 21 to 25.
+func extraterrestrialRadiation(latitude float64, day time.Time) (ra, sunsetAngle float64) {
+	phi := latitude * math.Pi / 180
+	j := float64(day.YearDay())
+	dr := 1 + 0.033*math.Cos(2*math.Pi/365*j)
+	declination := 0.409 * math.Sin(2*math.Pi/365*j-1.39)
+	sunsetAngle = math.Acos(math.Max(-1, math.Min(1, -math.Tan(phi)*math.Tan(declination))))
+	ra = 24 * 60 / math.Pi * 0.0820 * dr *
+		(sunsetAngle*math.Sin(phi)*math.Sin(declination) + math.Cos(phi)*math.Cos(declination)*math.Sin(sunsetAngle))
+	return ra, sunsetAngle
+}
+
+// penmanMonteith returns the FAO-56 reference evapotranspiration in mm/day
+// from the day's temperature extremes (°C), mean humidity (%), wind speed at
+// 2 m (m/s) and sunshine hours. Soil heat flux is neglected, as usual for
+// daily steps.
+func penmanMonteith(tn, tx, rh, u2, sunshine, latitude, elevation float64, day time.Time) float64 {
+	pressure := 101.3 * math.Pow((293-0.0065*elevation)/293, 5.26)
+	gamma := 0.000665 * pressure
+
+	tmean := (tx + tn) / 2
+	es := (saturationVaporPressure(tx) + saturationVaporPressure(tn)) / 2
+	ea := rh / 100 * es
+	delta := 4098 * saturationVaporPressure(tmean) / math.Pow(tmean+237.3, 2)
+
+	// Net radiation from the Angstrom estimate of solar radiation
+	ra, sunsetAngle := extraterrestrialRadiation(latitude, day)
+	possible := 24 / math.Pi * sunsetAngle
+	rs := (0.25 + 0.5*sunshine/possible) * ra
+	rso := (0.75 + 2e-5*elevation) * ra
+	rns := 0.77 * rs
+	rnl := 4.903e-9 * (math.Pow(tx+273.16, 4) + math.Pow(tn+273.16, 4)) / 2 *
+		(0.34 - 0.14*math.Sqrt(ea)) * (1.35*math.Min(1, rs/rso) - 0.35)
+	rn := rns - rnl
+
+	return (0.408*delta*rn + gamma*900/(tmean+273)*u2*(es-ea)) / (delta + gamma*(1+0.34*u2))
+}
+
+// hargreaves returns the Hargreaves reference evapotranspiration in mm/day,
+// which needs only the temperature extremes (FAO-56 equation 52).
+func hargreaves(tn, tx, latitude float64, day time.Time) float64 {
+	ra, _ := extraterrestrialRadiation(latitude, day)
+	return 0.0023 * ((tx+tn)/2 + 17.8) * math.Sqrt(math.Max(0, tx-tn)) * 0.408 * ra
+}
+
+// windAt2m converts a wind speed measured at height metres to 2 m, per
+// FAO-56 equation 47.
+func windAt2m(speed, height float64) float64 {
+	if height == 2 {
+		return speed
+	}
+	return speed * 4.87 / math.Log(67.8*height-5.42)
+}
+
+// parseWindHeight reads the anemometer height in metres, 10 by default.
+func parseWindHeight(v string) (float64, bool) {
+	if v == "" {
+		return 10, true
+	}
+	height, err := strconv.ParseFloat(v, 64)
+	return height, err == nil && height >= 0.5 && height <= 100
+}
+
+// dailyET0 estimates a day's reference evapotranspiration by FAO-56
+// Penman-Monteith, or by Hargreaves when humidity, wind or sunshine is
+// missing, and reports which method it used. There is no estimate without
+// both temperature extremes.
+func dailyET0(tn, tx, rh, wind, ss sql.NullFloat64, station Station, windHeight float64, day time.Time) (float64, string, bool) {
+	if !tn.Valid || !tx.Valid {
+		return 0, "", false
+	}
+	var et0 float64
+	method := "penman-monteith"
+	if rh.Valid && wind.Valid && ss.Valid {
+		et0 = penmanMonteith(tn.Float64, tx.Float64, rh.Float64, windAt2m(wind.Float64, windHeight), ss.Float64, station.Latitude, station.Elevation.Float64, day)
+	} else {
+		et0 = hargreaves(tn.Float64, tx.Float64, station.Latitude, day)
+		method = "hargreaves"
+	}
+	return math.Max(0, et0), method, true
+}
+
+// handleET0 returns the daily reference evapotranspiration series of a
+// station. Days with tn, tx, rh_avg, ff_avg and ss use FAO-56 Penman-Monteith;
+// days missing any of the latter three fall back to Hargreaves, and days
+// without both temperature extremes have no estimate. windHeight gives the
+// anemometer height in metres, 10 by default. A station without an elevation
+// is taken to be at sea level. n counts the days with an estimate.
+func (s *server) handleET0(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	windHeight, ok := parseWindHeight(values.Get("windHeight"))
+	if !ok {
+		httpError(w, r, "Invalid request. windHeight must be a height in metres between 0.5 and 100.", http.StatusBadRequest)
+		return
+	}
+
+	station, err := s.lookupStation(r.Context(), stationNumber)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	elevation := station.Elevation.Float64
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", tn, tx, rh_avg, ff_avg, ss FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 ORDER BY \"Tanggal\"",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type et0Day struct {
+		Date   string   `json:"date"`
+		ET0    *float64 `json:"et0"`
+		Method *string  `json:"method"`
+	}
+	days := []et0Day{}
+	estimated := 0
+	for rows.Next() {
+		var tanggal string
+		var tn, tx, rh, wind, ss sql.NullFloat64
+		if err := rows.Scan(&tanggal, &tn, &tx, &rh, &wind, &ss); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		// Sub-daily rows carry a time after the date; a row without a date
+		// is skipped, as in monthlyWaterBalance
+		date := tanggal
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		day, err := time.ParseInLocation("2006-01-02", date, stationTZ)
+		if err != nil {
+			continue
+		}
+
+		d := et0Day{Date: tanggal}
+		if et0, method, ok := dailyET0(tn, tx, rh, wind, ss, station, windHeight, day); ok {
+			d.ET0, d.Method = &et0, &method
+			estimated++
+		}
+		days = append(days, d)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string   `json:"station_number"`
+		Unit          string   `json:"unit"`
+		Latitude      float64  `json:"latitude"`
+		Elevation     float64  `json:"elevation"`
+		WindHeight    float64  `json:"wind_height"`
+		Days          []et0Day `json:"days"`
+		dataCoverage
+	}{stationNumber, "mm/day", station.Latitude, elevation, windHeight, days,
+		newDataCoverage(estimated, daysBetween(startDate, endDate))})
+}
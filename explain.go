@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// queryDB is the handlers' database handle. It notes down the queries of
+// requests made with explain, see withExplain; transactions are not noted.
+type queryDB struct {
+	*sql.DB
+}
+
+func (db *queryDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	noteQuery(ctx, query, args)
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *queryDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	noteQuery(ctx, query, args)
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (db *queryDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	noteQuery(ctx, query, args)
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+// explainedQuery is one statement a request ran, with the plan PostgreSQL
+// executed it by for explain=analyze.
+type explainedQuery struct {
+	SQL  string          `json:"sql"`
+	Args []interface{}   `json:"args"`
+	Plan json.RawMessage `json:"plan,omitempty"`
+}
+
+// queryLog collects the queries of one request; handlers may query from
+// several goroutines.
+type queryLog struct {
+	mu      sync.Mutex
+	queries []explainedQuery
+}
+
+type queryLogKey struct{}
+
+// noteQuery adds a query to the log of the request ctx belongs to, if any.
+func noteQuery(ctx context.Context, query string, args []interface{}) {
+	l, ok := ctx.Value(queryLogKey{}).(*queryLog)
+	if !ok {
+		return
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	l.mu.Lock()
+	l.queries = append(l.queries, explainedQuery{SQL: query, Args: args})
+	l.mu.Unlock()
+}
+
+// explaining reports whether the request ctx belongs to was made with explain.
+func explaining(ctx context.Context) bool {
+	_, ok := ctx.Value(queryLogKey{}).(*queryLog)
+	return ok
+}
+
+// withExplain lets admins see how a read endpoint gets its data: with
+// explain=true the response lists the parameterized SQL the handler ran and
+// its bound arguments, alongside the data the handler returned and its
+// status. explain=analyze adds the EXPLAIN ANALYZE plan of each SELECT,
+// which runs it a second time. The admin token is required, as the SQL
+// reveals the schema.
+func (s *server) withExplain(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("explain")
+		if mode == "" || mode == "false" {
+			next(w, r)
+			return
+		}
+		if mode != "true" && mode != "analyze" {
+			httpError(w, r, "Invalid request. explain must be true, false or analyze.", http.StatusBadRequest)
+			return
+		}
+
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			l := &queryLog{}
+			rec := &bufferedResponse{header: http.Header{}}
+			next(rec, r.WithContext(context.WithValue(r.Context(), queryLogKey{}, l)))
+			rec.status = rec.code()
+
+			queries := l.queries
+			if queries == nil {
+				queries = []explainedQuery{}
+			}
+			if mode == "analyze" {
+				for i, q := range queries {
+					if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(q.SQL)), "SELECT") {
+						continue
+					}
+					var plan string
+					if err := s.db.DB.QueryRowContext(r.Context(), "EXPLAIN (ANALYZE, FORMAT JSON) "+q.SQL, q.Args...).Scan(&plan); err != nil {
+						serverError(w, r, err)
+						return
+					}
+					queries[i].Plan = json.RawMessage(plan)
+				}
+			}
+
+			// Other bodies, such as CSV or a plain error message, are
+			// embedded as a string
+			var data json.RawMessage
+			if body := rec.body.Bytes(); json.Valid(body) {
+				data = body
+			} else if len(body) > 0 {
+				data, _ = json.Marshal(string(body))
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, r, struct {
+				Status  int              `json:"status"`
+				Queries []explainedQuery `json:"queries"`
+				Data    json.RawMessage  `json:"data"`
+			}{rec.status, queries, data})
+		})(w, r)
+	}
+}
+
+// bufferedResponse holds a response back instead of sending it.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+// code returns the status written, 200 when the handler wrote none, as the
+// server would have sent.
+func (b *bufferedResponse) code() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportJob tracks an export file generated in the background.
+type exportJob struct {
+	ID          string    `json:"id"`
+	Format      string    `json:"format"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	DownloadURL string    `json:"download_url,omitempty"`
+
+	// ExpiresAt is when a finished job is forgotten and its local file
+	// removed; an S3 download URL lapses at the same time
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	path  string
+	s3Key string
+}
+
+// exportSweepInterval is how often expired exports are cleared away.
+const exportSweepInterval = time.Minute
+
+// exportStore keeps export jobs in memory. Finished files are either left in
+// dir and streamed by the API, or uploaded to S3 when a client is configured.
+// Finished jobs expire, see sweep, so neither the jobs nor the files pile up.
+type exportStore struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+	dir  string
+	s3   *s3Client
+}
+
+// newExportStore writes exports to EXPORT_DIR, defaulting to a directory
+// under the system temp dir.
+func newExportStore(s3 *s3Client) (*exportStore, error) {
+	dir := config.ExportDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &exportStore{jobs: map[string]*exportJob{}, dir: dir, s3: s3}, nil
+}
+
+func (e *exportStore) get(id string) (exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Expired jobs are gone already, whether or not swept
+	job, ok := e.jobs[id]
+	if !ok || (job.ExpiresAt != nil && time.Now().After(*job.ExpiresAt)) {
+		return exportJob{}, false
+	}
+	return *job, true
+}
+
+func (e *exportStore) update(id string, fn func(*exportJob)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn(e.jobs[id])
+}
+
+// finish marks a job done or failed and sets when it expires: once its
+// download URL lapses for an export in S3, or after EXPORT_TTL otherwise.
+func (e *exportStore) finish(id string, fn func(*exportJob)) {
+	e.update(id, func(job *exportJob) {
+		fn(job)
+		ttl := config.ExportTTL
+		if job.s3Key != "" {
+			ttl = config.S3PresignTTL
+		}
+		expires := time.Now().Add(ttl)
+		job.ExpiresAt = &expires
+	})
+}
+
+// sweep forgets the jobs that expired by now and removes their files. Files
+// in dir that no job knows of, left behind by an earlier run of the server,
+// are removed once they are older than EXPORT_TTL.
+func (e *exportStore) sweep(now time.Time) {
+	e.mu.Lock()
+	var expired []string
+	known := map[string]bool{}
+	for id, job := range e.jobs {
+		if job.ExpiresAt != nil && now.After(*job.ExpiresAt) {
+			delete(e.jobs, id)
+			if job.path != "" {
+				expired = append(expired, job.path)
+			}
+			continue
+		}
+		known[id] = true
+	}
+	e.mu.Unlock()
+
+	for _, path := range expired {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println("export sweep:", err)
+		}
+	}
+
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		log.Println("export sweep:", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		id, ok := exportFileID(name)
+		if !ok || known[id] {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || now.Sub(info.ModTime()) < config.ExportTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(e.dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Println("export sweep:", err)
+		}
+	}
+}
+
+// sweepEvery runs sweep at every interval, for the life of the server.
+func (e *exportStore) sweepEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		e.sweep(now)
+	}
+}
+
+// exportFileID returns the job ID an export file name carries, if it is one.
+func exportFileID(name string) (string, bool) {
+	ext := filepath.Ext(name)
+	for _, format := range exportFormats {
+		if format.Ext == ext {
+			id := strings.TrimSuffix(name, ext)
+			_, err := hex.DecodeString(id)
+			return id, err == nil && len(id) == 32
+		}
+	}
+	return "", false
+}
+
+// exportFormats maps each export format to its file extension and type.
+var exportFormats = map[string]struct{ Ext, ContentType string }{
+	"csv":    {".csv", "text/csv"},
+	"tsv":    {".tsv", "text/tab-separated-values; charset=utf-8"},
+	"netcdf": {".nc", "application/x-netcdf"},
+}
+
+// exportRequest is what a background export writes.
+type exportRequest struct {
+	format        string
+	dataTypes     []string
+	columns       []string
+	header        []string
+	stationNumber string
+	station       Station
+	dr            dateRange
+	minQuality    string
+}
+
+// handleCreateExport starts an export of the same data /input/data serves,
+// as CSV, format=tsv tab-separated values or, with format=netcdf, as a
+// CF-compliant NetCDF file.
+func (s *server) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	dataTypes := strings.Split(values.Get("type"), ",")
+	for _, t := range dataTypes {
+		if !isWeatherColumn(t) {
+			httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(t)+".", http.StatusBadRequest)
+			return
+		}
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	minQuality, err := s.parseMinQuality(values.Get("minQuality"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := values.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if _, ok := exportFormats[format]; !ok {
+		httpError(w, r, "Invalid request. format must be csv, tsv or netcdf.", http.StatusBadRequest)
+		return
+	}
+
+	// Exports are downloads for people, so they default to labelled headers
+	headers := values.Get("headers")
+	if headers == "" {
+		headers = "labels"
+	}
+	dateFirst, err := parseDateFirst(values.Get("dateFirst"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	columns := s.outputColumns(dataTypes, dateFirst)
+	header, err := columnHeaders(columns, headers)
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// NetCDF files carry the station's coordinates
+	req := exportRequest{
+		format:        format,
+		dataTypes:     dataTypes,
+		columns:       columns,
+		header:        header,
+		stationNumber: stationNumber,
+		dr:            dateRange{Start: startDate, End: endDate},
+		minQuality:    minQuality,
+	}
+	if format == "netcdf" {
+		req.station, err = s.lookupStation(r.Context(), stationNumber)
+		if err == sql.ErrNoRows {
+			httpError(w, r, "Station not found.", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	job := &exportJob{ID: hex.EncodeToString(idBytes), Format: format, Status: "pending", CreatedAt: time.Now()}
+
+	s.exports.mu.Lock()
+	s.exports.jobs[job.ID] = job
+	s.exports.mu.Unlock()
+
+	go s.runExport(job.ID, req)
+
+	w.Header().Set("Location", "/exports/"+job.ID)
+	writeJSONStatus(w, r, http.StatusAccepted, job)
+}
+
+// runExport writes the export file and, when S3 is configured, uploads it.
+// CSV and TSV rows go to the file as they are read, so an export may be far
+// larger than memory; only NetCDF, whose variables are written one after the
+// other, holds every row at once.
+func (s *server) runExport(id string, req exportRequest) {
+	format := exportFormats[req.format]
+	path := filepath.Join(s.exports.dir, id+format.Ext)
+	fail := func(err error) {
+		log.Println("export", id+":", err)
+		os.Remove(path)
+		s.exports.finish(id, func(job *exportJob) {
+			job.Status = "failed"
+			job.Error = err.Error()
+		})
+	}
+
+	s.exports.update(id, func(job *exportJob) { job.Status = "running" })
+
+	quoted := make([]string, len(req.dataTypes))
+	for i, t := range req.dataTypes {
+		quoted[i] = `"` + t + `"`
+	}
+	selected := strings.Join(quoted, ",")
+
+	f, err := os.Create(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	// The export outlives the request that started it, and its deadline
+	ctx := context.Background()
+	switch req.format {
+	case "netcdf":
+		var results []map[string]interface{}
+		results, err = s.queryWeather(ctx, selected, req.stationNumber, req.dr, req.minQuality, nil, 0)
+		if err == nil {
+			var nc *ncFile
+			if nc, err = stationNetCDF(req.station, req.dataTypes, results); err == nil {
+				err = nc.write(f)
+			}
+		}
+	case "tsv":
+		ts := newTSVStream(f, req.columns)
+		if err = ts.WriteHeader(req.header); err == nil {
+			err = s.eachWeatherRow(ctx, selected, req.stationNumber, req.dr, req.minQuality, nil, ts.WriteRow)
+		}
+		if err == nil {
+			err = ts.Close()
+		}
+	default:
+		cw := csv.NewWriter(f)
+		cw.Write(req.header)
+		err = s.eachWeatherRow(ctx, selected, req.stationNumber, req.dr, req.minQuality, nil, func(row map[string]interface{}) error {
+			writeCSVRecord(cw, req.columns, row)
+			return cw.Error()
+		})
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	}
+	if err != nil {
+		f.Close()
+		fail(err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		fail(err)
+		return
+	}
+
+	if s.exports.s3 == nil {
+		s.exports.finish(id, func(job *exportJob) {
+			job.Status = "done"
+			job.path = path
+		})
+		return
+	}
+
+	// Hand the file over to object storage and drop the local copy
+	f, err = os.Open(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fail(err)
+		return
+	}
+	key := "exports/" + id + format.Ext
+	if err := s.exports.s3.Upload(key, f, info.Size(), format.ContentType); err != nil {
+		fail(err)
+		return
+	}
+	s.exports.finish(id, func(job *exportJob) {
+		job.Status = "done"
+		job.s3Key = key
+	})
+}
+
+// handleExport serves /exports/{id} (job status) and /exports/{id}/download.
+// Downloads honour Range requests, so interrupted transfers can resume.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/exports/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	job, ok := s.exports.get(id)
+	if !ok || (action != "" && action != "download") {
+		httpError(w, r, "Not found.", http.StatusNotFound)
+		return
+	}
+
+	if action == "download" {
+		if job.Status != "done" || job.path == "" {
+			httpError(w, r, "Export is not available for download.", http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(job.path)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		// An export never changes once written, so its ID serves as the ETag
+		// that If-Range compares when a client resumes a download
+		format := exportFormats[job.Format]
+		w.Header().Set("Content-Type", format.ContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="export-`+job.ID+format.Ext+`"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"`+job.ID+`"`)
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+
+	// Completed exports point at a presigned object URL when stored in S3,
+	// valid until the job expires, or at the local download endpoint otherwise
+	if job.Status == "done" {
+		if job.s3Key != "" {
+			job.DownloadURL = s.exports.s3.PresignGet(job.s3Key, time.Until(*job.ExpiresAt))
+		} else {
+			job.DownloadURL = "/exports/" + job.ID + "/download"
+		}
+	}
+
+	writeJSON(w, r, job)
+}
+
+// writeCSVRows writes each row's values for columns, in order.
+func writeCSVRows(cw *csv.Writer, columns []string, rows []map[string]interface{}) {
+	for _, row := range rows {
+		writeCSVRecord(cw, columns, row)
+	}
+}
+
+func writeCSVRecord(cw *csv.Writer, columns []string, row map[string]interface{}) {
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		record[i] = formatValue(row[col])
+	}
+	cw.Write(record)
+}
+
+// csvStream writes CSV rows to a response, pushing them to the client every
+// CSV_FLUSH_ROWS rows so large downloads progress steadily instead of sitting
+// in buffers. Flushing goes through the response writer, so any compression
+// layer flushes its pending output too.
+type csvStream struct {
+	cw      *csv.Writer
+	flusher http.Flusher
+	columns []string
+	rows    int
+}
+
+func newCSVStream(w http.ResponseWriter, columns []string) *csvStream {
+	flusher, _ := w.(http.Flusher)
+	return &csvStream{cw: csv.NewWriter(w), flusher: flusher, columns: columns}
+}
+
+// WriteHeader writes the header record and sends it straight away, so the
+// download starts before the first rows are read.
+func (c *csvStream) WriteHeader(header []string) error {
+	c.cw.Write(header)
+	return c.Flush()
+}
+
+func (c *csvStream) WriteRow(row map[string]interface{}) error {
+	writeCSVRecord(c.cw, c.columns, row)
+	c.rows++
+	if config.CSVFlushRows > 0 && c.rows%config.CSVFlushRows == 0 {
+		return c.Flush()
+	}
+	return nil
+}
+
+// Close flushes the remaining rows.
+func (c *csvStream) Close() error {
+	return c.Flush()
+}
+
+func (c *csvStream) Flush() error {
+	c.cw.Flush()
+	if err := c.cw.Error(); err != nil {
+		return err
+	}
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return nil
+}
+
+// formatValue renders a scanned column value as text, with NULL as empty.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.Format("2006-01-02")
+	default:
+		return fmt.Sprint(v)
+	}
+}
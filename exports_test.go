@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExportSweep checks that sweeping forgets expired jobs and removes their
+// files, and clears away stale files of jobs from an earlier run.
+func TestExportSweep(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	past, future := now.Add(-time.Second), now.Add(time.Hour)
+	id := func(c string) string { return strings.Repeat(c, 32) }
+
+	e := &exportStore{dir: dir, jobs: map[string]*exportJob{
+		id("a"): {ID: id("a"), Status: "done", ExpiresAt: &past, path: filepath.Join(dir, id("a")+".csv")},
+		id("b"): {ID: id("b"), Status: "done", ExpiresAt: &future, path: filepath.Join(dir, id("b")+".csv")},
+		id("c"): {ID: id("c"), Status: "running"},
+	}}
+	files := map[string]bool{
+		id("a") + ".csv": false, // expired
+		id("b") + ".csv": true,  // still downloadable
+		id("c") + ".nc":  true,  // being written
+		id("d") + ".tsv": false, // left behind long ago
+		id("e") + ".tsv": true,  // left behind just now
+		"notes.txt":      true,  // not an export
+	}
+	for name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := now.Add(-config.ExportTTL - time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, id("d")+".tsv"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	e.sweep(now)
+
+	if _, ok := e.jobs[id("a")]; ok {
+		t.Error("expired job was kept")
+	}
+	if len(e.jobs) != 2 {
+		t.Errorf("%d jobs left, want 2", len(e.jobs))
+	}
+	for name, keep := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept := err == nil; kept != keep {
+			t.Errorf("%s kept = %v, want %v", name, kept, keep)
+		}
+	}
+}
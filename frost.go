@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// frostMinCoverage is the fraction of days in a year that need a tn reading
+// for its frost dates to be reported; in sparser years the true dates may
+// well be missing.
+const frostMinCoverage = 0.8
+
+// frostYear holds the frost dates of one year. Status is "ok", "none" for a
+// year without frost, or "insufficient data".
+type frostYear struct {
+	Year             int     `json:"year"`
+	Status           string  `json:"status"`
+	LastSpringFrost  *string `json:"last_spring_frost"`
+	FirstAutumnFrost *string `json:"first_autumn_frost"`
+	FrostFreeDays    *int    `json:"frost_free_days"`
+	dataCoverage
+}
+
+// handleFrostDates returns, per year, the last spring frost and the first
+// autumn frost of a station, frost being a day with tn below threshold, 0 °C
+// by default. Spring is the first half of the calendar year and autumn the
+// second, as for the northern hemisphere; the frost-free period is the
+// number of days between the two. Days without a tn reading are ignored,
+// and years with fewer than 80% of days recorded are reported as
+// "insufficient data".
+func (s *server) handleFrostDates(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	threshold := 0.0
+	if v := values.Get("threshold"); v != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			httpError(w, r, "Invalid request. threshold must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT SUBSTRING(\"Tanggal\", 1, 10), tn < $2 FROM \"Weather\" WHERE station_number = $1 AND tn IS NOT NULL ORDER BY \"Tanggal\"",
+		stationNumber, threshold)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Rows are ordered by date, so years arrive in order too
+	years := []*frostYear{}
+	var lastSpring, firstAutumn []time.Time
+	for rows.Next() {
+		var tanggal string
+		var frost bool
+		if err := rows.Scan(&tanggal, &frost); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		day, err := time.ParseInLocation("2006-01-02", tanggal, stationTZ)
+		if err != nil {
+			continue
+		}
+
+		if len(years) == 0 || years[len(years)-1].Year != day.Year() {
+			years = append(years, &frostYear{Year: day.Year()})
+			lastSpring = append(lastSpring, time.Time{})
+			firstAutumn = append(firstAutumn, time.Time{})
+		}
+		i := len(years) - 1
+		years[i].N++
+		if !frost {
+			continue
+		}
+		if day.Month() <= time.June {
+			lastSpring[i] = day
+		} else if firstAutumn[i].IsZero() {
+			firstAutumn[i] = day
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	for i, y := range years {
+		y.dataCoverage = newDataCoverage(y.N, time.Date(y.Year, time.December, 31, 0, 0, 0, 0, stationTZ).YearDay())
+		switch {
+		case y.Completeness < frostMinCoverage:
+			y.Status = "insufficient data"
+			continue
+		case lastSpring[i].IsZero() && firstAutumn[i].IsZero():
+			y.Status = "none"
+			continue
+		}
+		y.Status = "ok"
+
+		// Without a frost on one side, the frost-free period runs to the
+		// start or end of the year
+		start := time.Date(y.Year, time.January, 1, 0, 0, 0, 0, stationTZ)
+		end := time.Date(y.Year, time.December, 31, 0, 0, 0, 0, stationTZ)
+		if !lastSpring[i].IsZero() {
+			date := lastSpring[i].Format("2006-01-02")
+			y.LastSpringFrost = &date
+			start = lastSpring[i].AddDate(0, 0, 1)
+		}
+		if !firstAutumn[i].IsZero() {
+			date := firstAutumn[i].Format("2006-01-02")
+			y.FirstAutumnFrost = &date
+			end = firstAutumn[i].AddDate(0, 0, -1)
+		}
+		days := daysBetween(start, end)
+		y.FrostFreeDays = &days
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string       `json:"station_number"`
+		Threshold     float64      `json:"threshold"`
+		Years         []*frostYear `json:"years"`
+	}{stationNumber, threshold, years})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// spellEvent is one heat wave or cold spell.
+type spellEvent struct {
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Duration int     `json:"duration"`
+	Peak     float64 `json:"peak"`
+	PeakDate string  `json:"peak_date"`
+}
+
+// handleHeatwaves finds the heat waves of a station within a date range:
+// runs of at least minDays, 3 by default, consecutive days with tx at or
+// above threshold, 35 °C by default. With kind=cold it finds cold spells
+// instead, runs of days with tn below threshold, 18 °C by default. Each
+// event's peak is its hottest tx or coldest tn. A day without a reading ends
+// a run, since it cannot be known to belong to it.
+func (s *server) handleHeatwaves(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	kind := values.Get("kind")
+	column, threshold := "tx", 35.0
+	switch kind {
+	case "", "heat":
+		kind = "heat"
+	case "cold":
+		column, threshold = "tn", 18.0
+	default:
+		httpError(w, r, "Invalid request. kind must be either heat or cold.", http.StatusBadRequest)
+		return
+	}
+
+	if v := values.Get("threshold"); v != "" {
+		threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			httpError(w, r, "Invalid request. threshold must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	minDays := 3
+	if v := values.Get("minDays"); v != "" {
+		minDays, err = strconv.Atoi(v)
+		if err != nil || minDays < 1 || minDays > 366 {
+			httpError(w, r, "Invalid request. minDays must be a number of days between 1 and 366.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", \""+column+"\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND \""+column+"\" IS NOT NULL",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	readings := map[string]float64{}
+	for rows.Next() {
+		var tanggal string
+		var value float64
+		if err := rows.Scan(&tanggal, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		readings[tanggal] = value
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Walk every calendar day so that gaps in the record end the runs
+	events := []spellEvent{}
+	var run *spellEvent
+	end := func() {
+		if run != nil && run.Duration >= minDays {
+			events = append(events, *run)
+		}
+		run = nil
+	}
+	for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		v, ok := readings[date]
+		if !ok || (kind == "heat" && v < threshold) || (kind == "cold" && v >= threshold) {
+			end()
+			continue
+		}
+		if run == nil {
+			run = &spellEvent{Start: date, Peak: v, PeakDate: date}
+		}
+		run.End = date
+		run.Duration++
+		if (kind == "heat" && v > run.Peak) || (kind == "cold" && v < run.Peak) {
+			run.Peak, run.PeakDate = v, date
+		}
+	}
+	end()
+
+	writeJSON(w, r, struct {
+		StationNumber string       `json:"station_number"`
+		Kind          string       `json:"kind"`
+		Type          string       `json:"type"`
+		Threshold     float64      `json:"threshold"`
+		MinDays       int          `json:"min_days"`
+		Events        []spellEvent `json:"events"`
+	}{stationNumber, kind, column, threshold, minDays, events})
+}
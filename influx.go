@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rowStream writes weather rows to a response as they are read from the
+// database, for the streamed /input/data formats.
+type rowStream interface {
+	WriteRow(row map[string]interface{}) error
+	Close() error
+}
+
+// influxStream writes weather rows as InfluxDB line protocol: the measurement
+// weather, tagged with the station, a field per non-NULL column and the
+// start of the day in station time as the timestamp, in nanoseconds. Line
+// protocol has no null, so NULL readings are left out, and rows without any
+// reading are skipped altogether.
+type influxStream struct {
+	bw      *bufio.Writer
+	flusher http.Flusher
+	prefix  string
+	columns []string
+	rows    int
+}
+
+// influxStringEscaper escapes a line protocol string field value.
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func newInfluxStream(w http.ResponseWriter, stationNumber string, columns []string) *influxStream {
+	flusher, _ := w.(http.Flusher)
+	return &influxStream{
+		bw:      bufio.NewWriter(w),
+		flusher: flusher,
+		prefix:  "weather,station_number=" + stationNumber + " ",
+		columns: columns,
+	}
+}
+
+func (s *influxStream) WriteRow(row map[string]interface{}) error {
+	day, err := time.ParseInLocation("2006-01-02", formatValue(row[dateColumn.Key]), stationTZ)
+	if err != nil {
+		return err
+	}
+
+	var fields []string
+	for _, col := range s.columns {
+		switch v := row[col].(type) {
+		case nil:
+		case string:
+			// Categorical labels are string fields
+			fields = append(fields, col+"=\""+influxStringEscaper.Replace(v)+"\"")
+		default:
+			f, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			if isIntegerColumn(col) {
+				fields = append(fields, col+"="+strconv.FormatInt(int64(f), 10)+"i")
+			} else {
+				fields = append(fields, col+"="+strconv.FormatFloat(f, 'f', -1, 64))
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	s.bw.WriteString(s.prefix + strings.Join(fields, ",") + " " + strconv.FormatInt(day.UnixNano(), 10) + "\n")
+	s.rows++
+	if config.CSVFlushRows > 0 && s.rows%config.CSVFlushRows == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// Close flushes the remaining lines.
+func (s *influxStream) Close() error {
+	return s.flush()
+}
+
+func (s *influxStream) flush() error {
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// weatherRecord is one day of observations as submitted for insertion.
+// Omitted and null readings are stored as NULL.
+type weatherRecord struct {
+	StationNumber int      `json:"station_number"`
+	Tanggal       string   `json:"Tanggal"`
+	DDDCar        *int64   `json:"ddd_car"`
+	Tn            *float64 `json:"tn"`
+	Tx            *float64 `json:"tx"`
+	Tavg          *float64 `json:"tavg"`
+	RHavg         *float64 `json:"rh_avg"`
+	RR            *float64 `json:"rr"`
+	Ss            *float64 `json:"ss"`
+	Ffx           *float64 `json:"ff_x"`
+	DDDX          *int64   `json:"ddd_x"`
+	Ffavg         *float64 `json:"ff_avg"`
+}
+
+// validateRecord checks a record before it is inserted: the date format and
+// that every reading is physically plausible. Tanggal is normalized to
+// YYYY-MM-DD, the form it is stored in.
+func validateRecord(rec *weatherRecord) error {
+	if rec.StationNumber <= 0 {
+		return errors.New("station_number must be a positive integer.")
+	}
+	day, err := parseDate(rec.Tanggal)
+	if err != nil {
+		return errors.New("Invalid Tanggal, " + err.Error())
+	}
+	rec.Tanggal = day.Format("2006-01-02")
+	for _, f := range []struct {
+		key      string
+		value    *float64
+		min, max float64
+	}{
+		{"tn", rec.Tn, -90, 60},
+		{"tx", rec.Tx, -90, 60},
+		{"tavg", rec.Tavg, -90, 60},
+		{"rh_avg", rec.RHavg, 0, 100},
+		{"rr", rec.RR, 0, 2000},
+		{"ss", rec.Ss, 0, 24},
+		{"ff_x", rec.Ffx, 0, 150},
+		{"ff_avg", rec.Ffavg, 0, 150},
+	} {
+		if f.value != nil && (*f.value < f.min || *f.value > f.max) {
+			return errors.New(f.key + " must be between " + strconv.FormatFloat(f.min, 'f', -1, 64) + " and " + strconv.FormatFloat(f.max, 'f', -1, 64) + ".")
+		}
+	}
+	for _, f := range []struct {
+		key   string
+		value *int64
+	}{{"ddd_car", rec.DDDCar}, {"ddd_x", rec.DDDX}} {
+		if f.value != nil && (*f.value < 0 || *f.value > 360) {
+			return errors.New(f.key + " must be a direction between 0 and 360 degrees.")
+		}
+	}
+	if rec.Tn != nil && rec.Tx != nil && *rec.Tn > *rec.Tx {
+		return errors.New("tn must not exceed tx.")
+	}
+	return nil
+}
+
+// insertRecord inserts a validated record, returning its id.
+func insertRecord(ctx context.Context, tx *sql.Tx, rec weatherRecord) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, "INSERT INTO \"Weather\" (station_number, \"Tanggal\", ddd_car, tn, tx, tavg, rh_avg, rr, ss, ff_x, ddd_x, ff_avg) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id",
+		rec.StationNumber, rec.Tanggal, rec.DDDCar, rec.Tn, rec.Tx, rec.Tavg, rec.RHavg, rec.RR, rec.Ss, rec.Ffx, rec.DDDX, rec.Ffavg).Scan(&id)
+	return id, err
+}
+
+// recordResult reports the outcome for the record at Index of a batch. OK
+// means the record itself passed; nothing is stored unless the whole batch
+// is committed.
+type recordResult struct {
+	Index int    `json:"index"`
+	OK    bool   `json:"ok"`
+	ID    *int   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleBatchInsert inserts a JSON array of records in a single transaction,
+// so either all of them are stored or none. Every record is validated first;
+// if any fails, or the database rejects one, nothing is inserted and the
+// response lists the outcome of each record by its index in the array.
+func (s *server) handleBatchInsert(w http.ResponseWriter, r *http.Request) {
+	var records []weatherRecord
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(config.MaxBatchRecords)<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&records); err != nil {
+		httpError(w, r, "Invalid request. The body must be a JSON array of Weather records: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(records) == 0 || len(records) > config.MaxBatchRecords {
+		httpError(w, r, "Invalid request. A batch must hold between 1 and "+strconv.Itoa(config.MaxBatchRecords)+" records.", http.StatusBadRequest)
+		return
+	}
+
+	respond := func(status int, committed bool, results []recordResult) {
+		inserted := 0
+		if committed {
+			inserted = len(results)
+		}
+		writeJSONStatus(w, r, status, struct {
+			Committed bool           `json:"committed"`
+			Inserted  int            `json:"inserted"`
+			Results   []recordResult `json:"results"`
+		}{committed, inserted, results})
+	}
+
+	results := make([]recordResult, len(records))
+	valid := true
+	for i := range records {
+		results[i] = recordResult{Index: i, OK: true}
+		if err := validateRecord(&records[i]); err != nil {
+			results[i] = recordResult{Index: i, Error: err.Error()}
+			valid = false
+		}
+	}
+	if !valid {
+		respond(http.StatusBadRequest, false, results)
+		return
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, rec := range records {
+		id, err := insertRecord(r.Context(), tx, rec)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Class() == "23" {
+			// A constraint violation, such as an unknown station, is the
+			// record's fault; the rest are reported as not attempted
+			results[i] = recordResult{Index: i, Error: pqErr.Message}
+			for j := range results {
+				if j != i {
+					results[j] = recordResult{Index: j, Error: "Not inserted, as the batch was rolled back."}
+				}
+			}
+			respond(http.StatusConflict, false, results)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		results[i].ID = &id
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	for _, rec := range records {
+		s.cache.invalidateStation(strconv.Itoa(rec.StationNumber))
+	}
+	respond(http.StatusCreated, true, results)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// earthRadiusKm is the mean Earth radius used for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// haversineKm returns the great-circle distance in km between two points
+// given in decimal degrees.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// parseCoordinates reads the lat and lon parameters.
+func parseCoordinates(latParam, lonParam string) (float64, float64, bool) {
+	lat, err := strconv.ParseFloat(latParam, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err := strconv.ParseFloat(lonParam, 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// contributor is a station taking part in an interpolated estimate.
+type contributor struct {
+	StationNumber int     `json:"station_number"`
+	StationName   string  `json:"station_name"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	DistanceKm    float64 `json:"distance_km"`
+	Value         float64 `json:"value"`
+	Weight        float64 `json:"weight"`
+}
+
+// handleInterpolate estimates a column's value for one day at an arbitrary
+// point by inverse distance weighting the k nearest stations with a reading
+// that day. Weights are 1/d^power, normalized to sum to 1; a station within
+// 10 m of the point is taken as is.
+func (s *server) handleInterpolate(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	lat, lon, ok := parseCoordinates(values.Get("lat"), values.Get("lon"))
+	if !ok {
+		httpError(w, r, "Invalid request. lat and lon must be decimal degrees.", http.StatusBadRequest)
+		return
+	}
+
+	dataType := values.Get("type")
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	day, err := parseDate(values.Get("date"))
+	if err != nil {
+		httpError(w, r, "Invalid request. Invalid date, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	date := day.Format("2006-01-02")
+
+	k := 4
+	if v := values.Get("k"); v != "" {
+		var err error
+		if k, err = strconv.Atoi(v); err != nil || k < 1 || k > 50 {
+			httpError(w, r, "Invalid request. k must be between 1 and 50.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	power := 2.0
+	if v := values.Get("power"); v != "" {
+		var err error
+		if power, err = strconv.ParseFloat(v, 64); err != nil || power <= 0 {
+			httpError(w, r, "Invalid request. power must be a positive number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT s.station_number, s.station_name, s.latitude, s.longitude, w.\""+dataType+"\" FROM \"Station\" s JOIN \"Weather\" w ON w.station_number = s.station_number WHERE w.\"Tanggal\" = $1 AND w.\""+dataType+"\" IS NOT NULL",
+		date)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	candidates := []contributor{}
+	for rows.Next() {
+		var c contributor
+		if err := rows.Scan(&c.StationNumber, &c.StationName, &c.Latitude, &c.Longitude, &c.Value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		c.DistanceKm = haversineKm(lat, lon, c.Latitude, c.Longitude)
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].DistanceKm < candidates[j].DistanceKm })
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	var estimate *float64
+	exact := len(candidates) > 0 && candidates[0].DistanceKm < 0.01
+	if len(candidates) > 0 {
+		if exact {
+			// Right on top of a station, whose reading is the best estimate
+			candidates = candidates[:1]
+			candidates[0].Weight = 1
+		} else {
+			total := 0.0
+			for i := range candidates {
+				candidates[i].Weight = 1 / math.Pow(candidates[i].DistanceKm, power)
+				total += candidates[i].Weight
+			}
+			for i := range candidates {
+				candidates[i].Weight /= total
+			}
+		}
+		sum := 0.0
+		for _, c := range candidates {
+			sum += c.Weight * c.Value
+		}
+		estimate = &sum
+	}
+
+	// Fewer stations than asked for had a reading that day
+	status := "ok"
+	switch {
+	case len(candidates) == 0:
+		status = "no_data"
+	case len(candidates) < k && !exact:
+		status = "partial"
+	}
+
+	writeJSON(w, r, struct {
+		Latitude  float64       `json:"latitude"`
+		Longitude float64       `json:"longitude"`
+		Type      string        `json:"type"`
+		Date      string        `json:"date"`
+		K         int           `json:"k"`
+		Power     float64       `json:"power"`
+		Status    string        `json:"status"`
+		Estimate  *float64      `json:"estimate"`
+		Stations  []contributor `json:"stations"`
+	}{lat, lon, dataType, date, k, power, status, estimate, candidates})
+}
@@ -2,73 +2,143 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	_ "github.com/lib/pq"
 )
 
-type Station struct {
-	StationNumber int             `json:"station_number"`
-	StationName   string          `json:"station_name"`
-	Latitude      float64         `json:"latitude"`
-	Longitude     float64         `json:"longitude"`
-	Elevation     sql.NullFloat64 `json:"elevation"`
+// stationTZ is the time zone the stations record their calendar days in. It is
+// configured with STATION_TZ (or TZ) and defaults to WIB.
+var stationTZ = time.FixedZone("WIB", 7*60*60)
+
+// loadStationTZ resolves the configured station time zone.
+func loadStationTZ() (*time.Location, error) {
+	if config.StationTZ == "" {
+		return stationTZ, nil
+	}
+	return time.LoadLocation(config.StationTZ)
 }
 
-type Weather struct {
-	ID            int             `json:"id"`
-	DDDCar        int             `json:"ddd_car"`
-	Tanggal       time.Time       `json:"tanggal"`
-	StationNumber int             `json:"station_number"`
-	Tn            sql.NullFloat64 `json:"tn"`
-	Tx            sql.NullFloat64 `json:"tx"`
-	Tavg          sql.NullFloat64 `json:"tavg"`
-	RHavg         sql.NullFloat64 `json:"rh_avg"`
-	RR            sql.NullFloat64 `json:"rr"`
-	Ss            sql.NullFloat64 `json:"ss"`
-	Ffx           sql.NullFloat64 `json:"ff_x"`
-	DDDX          sql.NullInt64   `json:"ddd_x"`
-	Ffavg         sql.NullFloat64 `json:"ff_avg"`
+// connectionString returns the PostgreSQL DSN along with a redacted summary
+// safe to log. PSQL takes precedence; otherwise the DSN is assembled from
+// DB_HOST, DB_PORT, DB_USER, DB_PASSWORD, DB_NAME and DB_SSLMODE.
+func connectionString() (string, string) {
+	if config.PSQL != "" {
+		return config.PSQL, "PSQL (redacted)"
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(config.DBHost, config.DBPort),
+		Path:     "/" + config.DBName,
+		RawQuery: url.Values{"sslmode": {config.DBSSLMode}}.Encode(),
+	}
+	if config.DBPassword != "" {
+		u.User = url.UserPassword(config.DBUser, config.DBPassword)
+	} else if config.DBUser != "" {
+		u.User = url.User(config.DBUser)
+	}
+	return u.String(), u.Redacted()
 }
 
-func (s Station) MarshalJSON() ([]byte, error) {
-	type Alias Station // Create an alias of the Station struct to avoid infinite recursion
-	if s.Elevation.Valid {
-		// Return the elevation value if it's valid
-		return json.Marshal(&struct {
-			Alias
-			Elevation float64 `json:"elevation"`
-		}{
-			Alias:     (Alias)(s),
-			Elevation: s.Elevation.Float64,
-		})
-	} else {
-		// Return null if the elevation is not valid
-		return json.Marshal(&struct {
-			Alias
-			Elevation interface{} `json:"elevation"`
-		}{
-			Alias:     (Alias)(s),
-			Elevation: nil,
-		})
+// listen opens the server listener. Addresses of the form "unix:/path" bind a
+// Unix domain socket, replacing any stale socket file left by a previous run;
+// anything else is treated as a TCP address.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// waitForDB pings the database until it answers, backing off exponentially
+// from DB_CONNECT_INTERVAL seconds between attempts, up to DB_CONNECT_ATTEMPTS
+// tries. Orchestrators often start the API before PostgreSQL accepts
+// connections, and crash-looping on the first failed ping helps nobody.
+func waitForDB(db *sql.DB) error {
+	attempts := config.DBConnectAttempts
+	delay := config.DBConnectInterval
+	const maxDelay = 30 * time.Second
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = db.Ping(); err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Database not ready (attempt %d of %d): %v; retrying in %s", attempt, attempts, err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
 	}
 }
 
 func main() {
+	migrateOnly := flag.Bool("migrate", false, "apply pending schema migrations and exit")
+	configPath := flag.String("config", "", "YAML or JSON file of settings, which the environment overrides")
+	flag.Parse()
+
+	// Refuse to start on missing or malformed configuration
+	settings, err := loadSettings(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if report, ok := validateSettings(settings); !ok {
+		fmt.Fprint(os.Stderr, report)
+		os.Exit(2)
+	}
+	config = newConfig(settings)
+	cacheMemory.limit = int64(config.CacheMemoryBytes)
+
+	tz, err := loadStationTZ()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stationTZ = tz
+
 	// PostgreSQL connection details
-	connStr := os.Getenv("PSQL")
+	connStr, summary := connectionString()
+	log.Println("Connecting to database", summary)
 
 	db, err := sql.Open("postgres", connStr)
 	defer db.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.SetMaxOpenConns(config.DBMaxOpenConns)
+	db.SetMaxIdleConns(config.DBMaxIdleConns)
+	db.SetConnMaxLifetime(config.DBConnMaxLifetime)
+	if err := waitForDB(db); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Connected to database")
+	// Apply schema migrations when asked to, either as a one-off with -migrate
+	// or on every start with MIGRATE_ON_START=true
+	if *migrateOnly || config.MigrateOnStart {
+		if err := migrate(db); err != nil {
+			log.Fatal(err)
+		}
+		if *migrateOnly {
+			return
+		}
+	}
+
 	// Execute the query to retrieve table names
 	rows, err := db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'")
 	if err != nil {
@@ -91,140 +161,40 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Define the route handler for fetching all rows
-	http.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
-
-		// Enable CORS
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		// Execute the query
-		rows, err := db.Query("SELECT * FROM \"Station\"")
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer rows.Close()
-
-		// Iterate over the rows and store them in a slice
-		stations := []Station{}
-		for rows.Next() {
-			var station Station
-			err := rows.Scan(&station.StationNumber, &station.StationName, &station.Latitude, &station.Longitude, &station.Elevation)
-			if err != nil {
-				log.Fatal(err)
-			}
-			stations = append(stations, station)
-		}
-
-		// Check for any errors during iteration
-		err = rows.Err()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Convert the slice to JSON
-		jsonData, err := json.Marshal(stations)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Set the Content-Type header and write the JSON response
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonData)
-	})
-
-	http.HandleFunc("/input/data", func(w http.ResponseWriter, r *http.Request) {
-		// Enable CORS
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		// Handle preflight requests
-		if r.Method == http.MethodOptions {
-			return
-		}
-
-		// Get the query parameters from the URL
-		values := r.URL.Query()
-		stationNumber := values.Get("stationNumber")
-		dateRange := values.Get("dateRange")
-		dataTypes := strings.Split(values.Get("type"), ",")
-
-		// Wrap each dataType with double quotes
-		for i := range dataTypes {
-			dataTypes[i] = `"` + dataTypes[i] + `"`
-		}
-
-		// Join the dataTypes with comma delimiter
-		dataType := strings.Join(dataTypes, ",")
-
-		// Handle the case when dataTypes is empty
-		if dataType == "\"\"" {
-			http.Error(w, "Invalid request. Missing data types.", http.StatusBadRequest)
-			return
-		}
-
-		if _, err := strconv.Atoi(stationNumber); err != nil {
-			http.Error(w, "Invalid request. Missing data types.", http.StatusBadRequest)
-			return
-		}
-
-		// Split the date range into start and end dates
-		dateRangeParts := strings.Split(dateRange, ",")
-
-		startDate, err := time.Parse("2006-01-02", dateRangeParts[0])
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		endDate, err := time.Parse("2006-01-02", dateRangeParts[1])
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Construct the SQL query based on the query parameters
-		query := "SELECT " + dataType + ",\"Tanggal\" FROM \"Weather\" WHERE station_number = $1 AND TO_DATE(\"Tanggal\", 'YYYY-MM-DD') BETWEEN $2 AND $3"
+	// Exports are uploaded to S3 when a bucket is configured and served
+	// locally otherwise
+	s3, err := newS3Client()
+	if err != nil {
+		log.Fatal(err)
+	}
+	exports, err := newExportStore(s3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go exports.sweepEvery(exportSweepInterval)
 
-		// Execute the query
-		rows, err := db.Query(query, stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer rows.Close()
-
-		// for each database row / record, a map with the column names and row values is added to the allMaps slice
-		var results []map[string]interface{}
-		columns, err := rows.Columns()
-
-		for rows.Next() {
-			values := make([]interface{}, len(columns))
-			pointers := make([]interface{}, len(columns))
-			for i := range values {
-				pointers[i] = &values[i]
-			}
-			err := rows.Scan(pointers...)
-			if err != nil {
-				log.Fatal(err)
-			}
-			resultMap := make(map[string]interface{})
-			for i, val := range values {
-				resultMap[columns[i]] = val
-			}
-			results = append(results, resultMap)
-		}
+	// Quality flags are surfaced only on databases that record them
+	qcFlag, err := detectQCFlag(db)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Convert the results to JSON
-		jsonData, err := json.Marshal(results)
-		if err != nil {
-			log.Fatal(err)
-		}
+	monthlySummary, err := detectMonthlySummary(db)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Set the Content-Type header and write the JSON response
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonData)
-	})
+	cache := newResponseCache(config.AggregateCacheSize, config.AggregateCacheTTL, cacheMemory, config.CacheStaleIfError)
+	srv := &server{db: &queryDB{db}, exports: exports, qcFlag: qcFlag, cache: cache}
+	srv.readOnly.Store(config.ReadOnly)
+	srv.monthlySummary.Store(monthlySummary)
 
-	// Start the server
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Start the server on a TCP address or, with a "unix:" prefix, a Unix socket
+	addr := config.ListenAddr
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Listening on", addr)
+	log.Fatal(http.Serve(listener, srv.handler()))
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// handleMetrics exposes counters in the Prometheus text format.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+
+	var hits, misses, evictions, staleHits, entries int64
+	if s.cache != nil {
+		hits, misses, evictions, staleHits = s.cache.hits.Load(), s.cache.misses.Load(), s.cache.evictions.Load(), s.cache.staleHits.Load()
+		entries = int64(s.cache.len())
+	}
+	metric("hujan_aggregate_cache_hits_total", "counter", "Aggregate responses served from the cache.", hits)
+	metric("hujan_aggregate_cache_misses_total", "counter", "Aggregate requests the cache could not answer.", misses)
+	metric("hujan_aggregate_cache_evictions_total", "counter", "Cached aggregate responses evicted to make room.", evictions)
+	metric("hujan_aggregate_cache_stale_total", "counter", "Failed aggregate requests answered with an expired cached response.", staleHits)
+	metric("hujan_aggregate_cache_entries", "gauge", "Aggregate responses currently cached.", entries)
+	metric("hujan_cache_memory_bytes", "gauge", "Approximate memory held by all in-memory caches.", cacheMemory.used.Load())
+	metric("hujan_cache_memory_limit_bytes", "gauge", "Memory budget shared by the in-memory caches.", cacheMemory.limit)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCORSOrigins reads CORS_ORIGINS, a comma-separated list of origins
+// such as https://example.org. Empty or * allows any origin, which is
+// returned as nil.
+func parseCORSOrigins(v string) ([]string, error) {
+	if strings.TrimSpace(v) == "" || strings.TrimSpace(v) == "*" {
+		return nil, nil
+	}
+	var origins []string
+	for _, origin := range strings.Split(v, ",") {
+		origin = strings.TrimSpace(origin)
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, errors.New("origin " + strconv.Quote(origin) + " must be a scheme and host such as https://example.org, or * alone")
+		}
+		origins = append(origins, strings.ToLower(origin))
+	}
+	return origins, nil
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, the empty string when CORS_ORIGINS does not list it.
+func allowOrigin(origin string) string {
+	if config.CORSOrigins == nil {
+		return "*"
+	}
+	for _, o := range config.CORSOrigins {
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors sets the CORS headers for a route serving the given methods and answers
+// preflight requests. Requests using any other method are rejected, except
+// that GET routes also answer HEAD; the server discards the body for those.
+// Only the origins in CORS_ORIGINS, when set, are allowed.
+func cors(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	for _, m := range methods {
+		if m == http.MethodGet {
+			methods = append(methods[:len(methods):len(methods)], http.MethodHead)
+			break
+		}
+	}
+	allowed := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Enable CORS for the allowed origins; the answer depends on the
+		// origin when they are listed, so caches must keep them apart
+		if config.CORSOrigins != nil {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin := allowOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allowed)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+
+		// Handle preflight requests
+		if r.Method == http.MethodOptions {
+			return
+		}
+
+		for _, m := range methods {
+			if r.Method == m {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allowed)
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireAdmin wraps a handler so it is only reachable with the bearer token
+// configured in ADMIN_TOKEN. When no token is configured the endpoint is
+// disabled entirely.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.AdminToken
+		if token == "" {
+			httpError(w, r, "Admin endpoints are disabled.", http.StatusForbidden)
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, r, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// limitConcurrency rejects requests with 503 once limit requests are already
+// in flight, so spikes back off before the connection pool is exhausted. A
+// limit of zero or less disables the cap.
+func limitConcurrency(limit int, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, "Server is busy, please retry shortly.", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// withDeadline gives every request a single deadline, budget from its
+// arrival, that the database calls downstream derive their contexts from.
+// Queries still running at the deadline are cancelled and the request
+// answers 504 through serverError.
+func withDeadline(budget time.Duration, next http.Handler) http.Handler {
+	if budget <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rejectWritesWhenReadOnly answers mutating requests with 503 while the
+// server is in read-only mode, e.g. during database maintenance. Safe methods
+// pass through.
+func (s *server) rejectWritesWhenReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if s.readOnly.Load() {
+				w.Header().Set("Retry-After", "300")
+				httpError(w, r, "The API is in read-only mode for maintenance. Writes are temporarily disabled.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// compress gzips responses for clients that accept it. Flushing the response
+// flushes the compressor first, so streamed responses still arrive in
+// chunks. Responses that serve byte ranges are left uncompressed, since
+// ranges refer to the uncompressed bytes.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	head        bool
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	h := g.Header()
+	h.Add("Vary", "Accept-Encoding")
+	compressible := code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && h.Get("Accept-Ranges") == "" && h.Get("Content-Range") == ""
+	if compressible && !g.head {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		// Sniff the type from the uncompressed bytes, as net/http otherwise
+		// would from the compressed ones
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// checkLogFormat validates LOG_FORMAT.
+func checkLogFormat(v string) error {
+	switch v {
+	case "common", "combined", "json", "off":
+		return nil
+	}
+	return errors.New("must be common, combined, json or off")
+}
+
+// accessLog is where logRequests writes, one line per request with no prefix
+// of its own, as each format carries its own timestamp.
+var accessLog = log.New(os.Stdout, "", 0)
+
+// logRequests writes an access log line for every request in the given
+// format: common or combined, as in Apache, or json for structured logging.
+// "off" disables the access log. The name of the API key used, if any, is
+// logged as the user.
+func logRequests(format string, next http.Handler) http.Handler {
+	if format == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		r, info := withRequestInfo(r)
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		accessLog.Print(accessLogLine(format, r, rec, info, start))
+	})
+}
+
+func accessLogLine(format string, r *http.Request, rec *statusRecorder, info *requestInfo, start time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if format == "json" {
+		line, _ := json.Marshal(struct {
+			Time       string  `json:"time"`
+			RemoteAddr string  `json:"remote_addr"`
+			Method     string  `json:"method"`
+			URI        string  `json:"uri"`
+			Proto      string  `json:"proto"`
+			APIKey     string  `json:"api_key,omitempty"`
+			Status     int     `json:"status"`
+			Bytes      int64   `json:"bytes"`
+			DurationMs float64 `json:"duration_ms"`
+			Referer    string  `json:"referer,omitempty"`
+			UserAgent  string  `json:"user_agent,omitempty"`
+		}{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			RemoteAddr: host,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			APIKey:     info.apiKey,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		})
+		return string(line)
+	}
+
+	// Apache logs "-" for an empty body and for unknown fields
+	size := "-"
+	if rec.bytes > 0 {
+		size = fmt.Sprint(rec.bytes)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s", host, orDash(info.apiKey), start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, size)
+	if format == "combined" {
+		line += fmt.Sprintf(" %q %q", orDash(r.Referer()), orDash(r.UserAgent()))
+	}
+	return line
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// statusRecorder captures the status code and body size of a response. It
+// passes flushes through so streamed responses keep streaming.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
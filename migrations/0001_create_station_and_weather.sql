@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS "Station" (
+    station_number integer PRIMARY KEY,
+    station_name   text NOT NULL,
+    latitude       double precision NOT NULL,
+    longitude      double precision NOT NULL,
+    elevation      double precision
+);
+
+CREATE TABLE IF NOT EXISTS "Weather" (
+    id             serial PRIMARY KEY,
+    ddd_car        integer,
+    "Tanggal"      text NOT NULL,
+    station_number integer NOT NULL REFERENCES "Station" (station_number),
+    tn             double precision,
+    tx             double precision,
+    tavg           double precision,
+    rh_avg         double precision,
+    rr             double precision,
+    ss             double precision,
+    ff_x           double precision,
+    ddd_x          integer,
+    ff_avg         double precision
+);
+
+-- Every read filters on a station and a range of days. Queries compare the
+-- raw "Tanggal" text (YYYY-MM-DD sorts chronologically) so this index applies;
+-- wrapping the column in TO_DATE would force a sequential scan.
+CREATE INDEX IF NOT EXISTS weather_station_tanggal_idx ON "Weather" (station_number, "Tanggal");
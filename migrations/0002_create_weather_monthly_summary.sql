@@ -0,0 +1,19 @@
+-- Monthly aggregates per station, read by /aggregate/monthly for the months
+-- a request covers in full. Refresh it through POST /admin/refresh-summary
+-- after loading new observations; the unique index lets the refresh run
+-- CONCURRENTLY, without blocking readers.
+CREATE MATERIALIZED VIEW IF NOT EXISTS weather_monthly_summary AS
+SELECT station_number,
+       SUBSTRING("Tanggal", 1, 7) AS month,
+       AVG(tn)     AS tn,
+       AVG(tx)     AS tx,
+       AVG(tavg)   AS tavg,
+       AVG(rh_avg) AS rh_avg,
+       SUM(rr)     AS rr,
+       SUM(ss)     AS ss,
+       AVG(ff_avg) AS ff_avg,
+       COUNT(*)    AS days
+FROM "Weather"
+GROUP BY 1, 2;
+
+CREATE UNIQUE INDEX IF NOT EXISTS weather_monthly_summary_idx ON weather_monthly_summary (station_number, month);
@@ -0,0 +1,9 @@
+-- Rows moved out of "Weather" by DELETE /weather?archive=true, stamped with
+-- when they were archived. The archive copies the columns "Weather" has when
+-- this migration runs, so a qc_flag column added since must be added here too.
+CREATE TABLE IF NOT EXISTS "WeatherArchive" (
+    LIKE "Weather",
+    archived_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS weather_archive_station_tanggal_idx ON "WeatherArchive" (station_number, "Tanggal");
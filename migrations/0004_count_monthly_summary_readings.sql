@@ -0,0 +1,20 @@
+-- weather_monthly_summary counted rows as days, so a month of rows without
+-- rainfall readings still looked complete. Rebuild it counting the days with
+-- an rr reading instead, matching the live aggregation in monthly.go.
+DROP MATERIALIZED VIEW IF EXISTS weather_monthly_summary;
+
+CREATE MATERIALIZED VIEW weather_monthly_summary AS
+SELECT station_number,
+       SUBSTRING("Tanggal", 1, 7) AS month,
+       AVG(tn)     AS tn,
+       AVG(tx)     AS tx,
+       AVG(tavg)   AS tavg,
+       AVG(rh_avg) AS rh_avg,
+       SUM(rr)     AS rr,
+       SUM(ss)     AS ss,
+       AVG(ff_avg) AS ff_avg,
+       COUNT(rr)   AS days
+FROM "Weather"
+GROUP BY 1, 2;
+
+CREATE UNIQUE INDEX weather_monthly_summary_idx ON weather_monthly_summary (station_number, month);
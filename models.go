@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type Station struct {
+	StationNumber int             `json:"station_number"`
+	StationName   string          `json:"station_name"`
+	Latitude      float64         `json:"latitude"`
+	Longitude     float64         `json:"longitude"`
+	Elevation     sql.NullFloat64 `json:"elevation"`
+}
+
+type Weather struct {
+	ID            int             `json:"id"`
+	DDDCar        sql.NullInt64   `json:"ddd_car"`
+	Tanggal       time.Time       `json:"tanggal"`
+	StationNumber int             `json:"station_number"`
+	Tn            sql.NullFloat64 `json:"tn"`
+	Tx            sql.NullFloat64 `json:"tx"`
+	Tavg          sql.NullFloat64 `json:"tavg"`
+	RHavg         sql.NullFloat64 `json:"rh_avg"`
+	RR            sql.NullFloat64 `json:"rr"`
+	Ss            sql.NullFloat64 `json:"ss"`
+	Ffx           sql.NullFloat64 `json:"ff_x"`
+	DDDX          sql.NullInt64   `json:"ddd_x"`
+	Ffavg         sql.NullFloat64 `json:"ff_avg"`
+}
+
+func (s Station) MarshalJSON() ([]byte, error) {
+	type Alias Station // Create an alias of the Station struct to avoid infinite recursion
+	if s.Elevation.Valid {
+		// Return the elevation value if it's valid
+		return json.Marshal(&struct {
+			Alias
+			Elevation float64 `json:"elevation"`
+		}{
+			Alias:     (Alias)(s),
+			Elevation: s.Elevation.Float64,
+		})
+	} else {
+		// Return null if the elevation is not valid
+		return json.Marshal(&struct {
+			Alias
+			Elevation interface{} `json:"elevation"`
+		}{
+			Alias:     (Alias)(s),
+			Elevation: nil,
+		})
+	}
+}
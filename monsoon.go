@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// onsetCriterion parameterizes the rainy season onset test. The defaults are
+// the agronomic criterion common for Indonesia: the first 5 days totalling at
+// least 40 mm, not followed by a dry spell of 10 or more days within 30 days.
+type onsetCriterion struct {
+	From        string  `json:"from"`
+	Window      int     `json:"window"`
+	Threshold   float64 `json:"threshold"`
+	WetDay      float64 `json:"wet_day"`
+	DrySpell    int     `json:"dry_spell"`
+	Lookahead   int     `json:"lookahead"`
+	MinCoverage float64 `json:"min_coverage"`
+}
+
+// onsetSearchDays is how long after the start date the onset is searched.
+const onsetSearchDays = 365
+
+// handleMonsoonOnset finds the onset of the rainy season that starts in year.
+// Beginning on from (MM-DD, default 09-01), the onset is the first day of
+// the first window days in a row, all recorded, whose rr totals at least
+// threshold mm, provided the lookahead days after them hold no dry spell,
+// drySpell recorded days in a row with less than wetDay mm. Days missing
+// from the lookahead neither extend nor break a dry spell. The status is
+// "ok", "not_found" when no day qualifies, or "insufficient_data" when less
+// than minCoverage of the searched days have an rr reading.
+func (s *server) handleMonsoonOnset(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(values.Get("year"))
+	if err != nil || year < 1 || year > 9999 {
+		httpError(w, r, "Invalid request. year must be a four digit year.", http.StatusBadRequest)
+		return
+	}
+
+	c := onsetCriterion{From: "09-01", Window: 5, Threshold: 40, WetDay: 1, DrySpell: 10, Lookahead: 30, MinCoverage: 0.8}
+	if v := values.Get("from"); v != "" {
+		c.From = v
+	}
+	start, err := time.ParseInLocation("2006-01-02", strconv.Itoa(year)+"-"+c.From, stationTZ)
+	if err != nil {
+		httpError(w, r, "Invalid request. from must be a day of the year as MM-DD.", http.StatusBadRequest)
+		return
+	}
+	for _, p := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"window", &c.Window, 1, 60},
+		{"drySpell", &c.DrySpell, 1, 120},
+		{"lookahead", &c.Lookahead, 0, 120},
+	} {
+		if v := values.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < p.min || n > p.max {
+				httpError(w, r, "Invalid request. "+p.name+" must be a number of days between "+strconv.Itoa(p.min)+" and "+strconv.Itoa(p.max)+".", http.StatusBadRequest)
+				return
+			}
+			*p.value = n
+		}
+	}
+	for _, p := range []struct {
+		name     string
+		value    *float64
+		max      float64
+		expected string
+	}{
+		{"threshold", &c.Threshold, math.Inf(1), "a non-negative amount in mm"},
+		{"wetDay", &c.WetDay, math.Inf(1), "a non-negative amount in mm"},
+		{"minCoverage", &c.MinCoverage, 1, "a fraction between 0 and 1"},
+	} {
+		if v := values.Get(p.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > p.max {
+				httpError(w, r, "Invalid request. "+p.name+" must be "+p.expected+".", http.StatusBadRequest)
+				return
+			}
+			*p.value = f
+		}
+	}
+
+	// Read the searched days plus the window and lookahead past their end,
+	// indexed by day since start
+	end := start.AddDate(0, 0, onsetSearchDays-1)
+	last := end.AddDate(0, 0, c.Window+c.Lookahead)
+	total := daysBetween(start, last)
+	rain := make([]sql.NullFloat64, total)
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT SUBSTRING(\"Tanggal\", 1, 10), rr FROM \"Weather\" WHERE station_number = $1 AND rr IS NOT NULL AND \"Tanggal\" BETWEEN $2 AND $3",
+		stationNumber, start.Format("2006-01-02"), last.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tanggal string
+		var rr float64
+		if err := rows.Scan(&tanggal, &rr); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		day, err := time.ParseInLocation("2006-01-02", tanggal, stationTZ)
+		if err != nil {
+			continue
+		}
+		if i := daysBetween(start, day) - 1; i >= 0 && i < total {
+			rain[i] = sql.NullFloat64{Float64: rr, Valid: true}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	recorded := 0
+	for _, v := range rain[:onsetSearchDays] {
+		if v.Valid {
+			recorded++
+		}
+	}
+
+	result := struct {
+		StationNumber string         `json:"station_number"`
+		Year          int            `json:"year"`
+		Status        string         `json:"status"`
+		Onset         *string        `json:"onset"`
+		DayOfSeason   *int           `json:"day_of_season"`
+		WindowTotal   *float64       `json:"window_total"`
+		Criterion     onsetCriterion `json:"criterion"`
+		dataCoverage
+	}{
+		StationNumber: stationNumber,
+		Year:          year,
+		Status:        "not_found",
+		Criterion:     c,
+		dataCoverage:  newDataCoverage(recorded, onsetSearchDays),
+	}
+	if result.Completeness < c.MinCoverage {
+		result.Status = "insufficient_data"
+		writeJSON(w, r, result)
+		return
+	}
+
+	for i := 0; i < onsetSearchDays; i++ {
+		sum, complete := 0.0, true
+		for _, v := range rain[i : i+c.Window] {
+			complete = complete && v.Valid
+			sum += v.Float64
+		}
+		if !complete || sum < c.Threshold || hasDrySpell(rain[i+c.Window:i+c.Window+c.Lookahead], c.WetDay, c.DrySpell) {
+			continue
+		}
+
+		onset := start.AddDate(0, 0, i).Format("2006-01-02")
+		day := i + 1
+		result.Status, result.Onset, result.DayOfSeason, result.WindowTotal = "ok", &onset, &day, &sum
+		break
+	}
+
+	writeJSON(w, r, result)
+}
+
+// hasDrySpell reports whether days holds spell recorded days in a row below
+// wetDay mm. Missing days are skipped over.
+func hasDrySpell(days []sql.NullFloat64, wetDay float64, spell int) bool {
+	run := 0
+	for _, v := range days {
+		if !v.Valid {
+			continue
+		}
+		if v.Float64 >= wetDay {
+			run = 0
+			continue
+		}
+		if run++; run >= spell {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// monthlyAggregate is one month of a station's observations: the mean of the
+// temperature, humidity and wind columns and the totals of rr and ss.
+type monthlyAggregate struct {
+	Month  string   `json:"month"`
+	Tn     *float64 `json:"tn"`
+	Tx     *float64 `json:"tx"`
+	Tavg   *float64 `json:"tavg"`
+	RHavg  *float64 `json:"rh_avg"`
+	RR     *float64 `json:"rr"`
+	SS     *float64 `json:"ss"`
+	FFavg  *float64 `json:"ff_avg"`
+	Source string   `json:"source"`
+	dataCoverage
+}
+
+// monthlyColumns is the select list shared by the live aggregation and the
+// weather_monthly_summary view, which stores the same expressions. The count
+// is of the days with an rr reading, not of rows, so that coverage reflects
+// the rainfall total it qualifies.
+const monthlyColumns = "AVG(tn), AVG(tx), AVG(tavg), AVG(rh_avg), SUM(rr), SUM(ss), AVG(ff_avg), COUNT(rr)"
+
+// detectMonthlySummary reports whether the weather_monthly_summary view
+// exists.
+func detectMonthlySummary(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass('weather_monthly_summary') IS NOT NULL").Scan(&exists)
+	return exists, err
+}
+
+// scanMonthly reads monthlyAggregate rows of month followed by the
+// monthlyColumns.
+func scanMonthly(rows *sql.Rows, source string) ([]monthlyAggregate, error) {
+	defer rows.Close()
+	months := []monthlyAggregate{}
+	for rows.Next() {
+		var m monthlyAggregate
+		var values [7]sql.NullFloat64
+		if err := rows.Scan(&m.Month, &values[0], &values[1], &values[2], &values[3], &values[4], &values[5], &values[6], &m.N); err != nil {
+			return nil, err
+		}
+		fields := [7]**float64{&m.Tn, &m.Tx, &m.Tavg, &m.RHavg, &m.RR, &m.SS, &m.FFavg}
+		for i, v := range values {
+			if v.Valid {
+				f := v.Float64
+				*fields[i] = &f
+			}
+		}
+		m.Source = source
+		months = append(months, m)
+	}
+	return months, rows.Err()
+}
+
+// liveMonthly aggregates the observations between start and end that meet
+// where on the fly.
+func (s *server) liveMonthly(ctx context.Context, stationNumber string, start, end time.Time, where whereClause) ([]monthlyAggregate, error) {
+	if end.Before(start) {
+		return nil, nil
+	}
+	cond, args := where.sql([]interface{}{stationNumber, start.Format("2006-01-02"), end.Format("2006-01-02")})
+	rows, err := s.db.QueryContext(ctx, "SELECT SUBSTRING(\"Tanggal\", 1, 7), "+monthlyColumns+" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3"+cond+" GROUP BY 1 ORDER BY 1",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanMonthly(rows, "live")
+}
+
+// handleMonthly returns monthly aggregates for a station over a date range.
+// Months the range covers in full are read from the weather_monthly_summary
+// view when the database has it; partial months at either end, and every
+// month on databases without the view, are aggregated live, so ad-hoc ranges
+// stay exact. The view is only as fresh as its last refresh. A where
+// condition such as rr>1 restricts the aggregates to the days meeting it,
+// which the view cannot answer, so those are always aggregated live.
+func (s *server) handleMonthly(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, err := parseWhere(values.Get("where"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The full months are those from the first month starting within the
+	// range to the last one ending within it
+	fullStart := time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, stationTZ)
+	if fullStart.Before(startDate) {
+		fullStart = fullStart.AddDate(0, 1, 0)
+	}
+	fullEnd := time.Date(endDate.Year(), endDate.Month()+1, 0, 0, 0, 0, 0, stationTZ)
+	if fullEnd.After(endDate) {
+		fullEnd = time.Date(endDate.Year(), endDate.Month(), 0, 0, 0, 0, 0, stationTZ)
+	}
+
+	// Appended to rather than assigned, so no data encodes as [] and not null
+	months := []monthlyAggregate{}
+	if s.monthlySummary.Load() && where.Column == "" && !fullEnd.Before(fullStart) {
+		head, err := s.liveMonthly(r.Context(), stationNumber, startDate, fullStart.AddDate(0, 0, -1), where)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		rows, err := s.db.QueryContext(r.Context(), "SELECT month, tn, tx, tavg, rh_avg, rr, ss, ff_avg, days FROM weather_monthly_summary WHERE station_number = $1 AND month BETWEEN $2 AND $3 ORDER BY month",
+			stationNumber, fullStart.Format("2006-01"), fullEnd.Format("2006-01"))
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		body, err := scanMonthly(rows, "summary")
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		tail, err := s.liveMonthly(r.Context(), stationNumber, fullEnd.AddDate(0, 0, 1), endDate, where)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		months = append(append(append(months, head...), body...), tail...)
+	} else {
+		live, err := s.liveMonthly(r.Context(), stationNumber, startDate, endDate, where)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		months = append(months, live...)
+	}
+
+	for i := range months {
+		months[i].dataCoverage = newDataCoverage(months[i].N, periodDays(months[i].Month, "month", startDate, endDate))
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string             `json:"station_number"`
+		Months        []monthlyAggregate `json:"months"`
+	}{stationNumber, months})
+}
+
+// handleRefreshSummary rebuilds the weather_monthly_summary view from the
+// current observations.
+func (s *server) handleRefreshSummary(w http.ResponseWriter, r *http.Request) {
+	exists, err := detectMonthlySummary(s.db.DB)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.monthlySummary.Store(exists)
+	if !exists {
+		httpError(w, r, "The weather_monthly_summary view does not exist; run the migrations first.", http.StatusNotFound)
+		return
+	}
+
+	start := time.Now()
+	if _, err := s.db.ExecContext(r.Context(), "REFRESH MATERIALIZED VIEW CONCURRENTLY weather_monthly_summary"); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// Cached /aggregate/monthly responses may predate the refresh
+	s.cache.clear()
+
+	writeJSON(w, r, struct {
+		Refreshed  bool  `json:"refreshed"`
+		DurationMs int64 `json:"duration_ms"`
+	}{true, time.Since(start).Milliseconds()})
+}
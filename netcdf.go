@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// NetCDF classic format tags and external types.
+const (
+	ncDimensionTag = 10
+	ncVariableTag  = 11
+	ncAttributeTag = 12
+
+	ncChar   = 2
+	ncInt    = 4
+	ncDouble = 6
+)
+
+// ncFillDouble is the NetCDF default fill value for doubles, used for
+// missing readings.
+const ncFillDouble = 9.9692099683868690e+36
+
+// ncDim is a fixed-length NetCDF dimension.
+type ncDim struct {
+	Name string
+	Len  int
+}
+
+// ncAttr is a NetCDF attribute; Value is a string, an int32 or a float64.
+type ncAttr struct {
+	Name  string
+	Value interface{}
+}
+
+// ncVar is a double variable over the dimensions indexed by Dims. Scalar
+// variables have no dimensions and a single value.
+type ncVar struct {
+	Name  string
+	Dims  []int
+	Attrs []ncAttr
+	Data  []float64
+}
+
+// ncFile is a NetCDF dataset small enough to hold in memory.
+type ncFile struct {
+	Dims  []ncDim
+	Attrs []ncAttr
+	Vars  []ncVar
+}
+
+// write encodes f in the 64-bit offset classic format (CDF-2), which every
+// NetCDF reader understands. Variables follow the header in order, each
+// taking the product of its dimension lengths in doubles.
+func (f *ncFile) write(w io.Writer) error {
+	// The header is the same size whatever the offsets in it, so a first
+	// pass with zero offsets tells where the data begins
+	begins := make([]int64, len(f.Vars))
+	offset := int64(len(f.header(begins)))
+	for i, v := range f.Vars {
+		begins[i] = offset
+		offset += int64(8 * len(v.Data))
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(f.header(begins)); err != nil {
+		return err
+	}
+	var buf [8]byte
+	for _, v := range f.Vars {
+		for _, value := range v.Data {
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(value))
+			if _, err := bw.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// header encodes the magic number, dimensions, global attributes and
+// variable definitions, with the variables' data at begins.
+func (f *ncFile) header(begins []int64) []byte {
+	var b bytes.Buffer
+	b.WriteString("CDF\x02")
+	ncPutInt(&b, 0) // no record dimension, so no records
+
+	if len(f.Dims) == 0 {
+		ncPutInt(&b, 0)
+		ncPutInt(&b, 0)
+	} else {
+		ncPutInt(&b, ncDimensionTag)
+		ncPutInt(&b, len(f.Dims))
+		for _, d := range f.Dims {
+			ncPutName(&b, d.Name)
+			ncPutInt(&b, d.Len)
+		}
+	}
+
+	ncPutAttrs(&b, f.Attrs)
+
+	if len(f.Vars) == 0 {
+		ncPutInt(&b, 0)
+		ncPutInt(&b, 0)
+	} else {
+		ncPutInt(&b, ncVariableTag)
+		ncPutInt(&b, len(f.Vars))
+		for i, v := range f.Vars {
+			ncPutName(&b, v.Name)
+			ncPutInt(&b, len(v.Dims))
+			for _, d := range v.Dims {
+				ncPutInt(&b, d)
+			}
+			ncPutAttrs(&b, v.Attrs)
+			ncPutInt(&b, ncDouble)
+			// vsize saturates for variables over 4 GiB, as the format allows
+			vsize := int64(8 * len(v.Data))
+			if vsize > math.MaxUint32-3 {
+				vsize = math.MaxUint32
+			}
+			binary.Write(&b, binary.BigEndian, uint32(vsize))
+			binary.Write(&b, binary.BigEndian, begins[i])
+		}
+	}
+	return b.Bytes()
+}
+
+func ncPutInt(b *bytes.Buffer, n int) {
+	binary.Write(b, binary.BigEndian, int32(n))
+}
+
+// ncPad zero-pads b to the 4-byte boundary the format aligns everything to.
+func ncPad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+func ncPutName(b *bytes.Buffer, name string) {
+	ncPutInt(b, len(name))
+	b.WriteString(name)
+	ncPad(b)
+}
+
+func ncPutAttrs(b *bytes.Buffer, attrs []ncAttr) {
+	if len(attrs) == 0 {
+		ncPutInt(b, 0)
+		ncPutInt(b, 0)
+		return
+	}
+	ncPutInt(b, ncAttributeTag)
+	ncPutInt(b, len(attrs))
+	for _, a := range attrs {
+		ncPutName(b, a.Name)
+		switch v := a.Value.(type) {
+		case string:
+			ncPutInt(b, ncChar)
+			ncPutInt(b, len(v))
+			b.WriteString(v)
+			ncPad(b)
+		case int32:
+			ncPutInt(b, ncInt)
+			ncPutInt(b, 1)
+			binary.Write(b, binary.BigEndian, v)
+		case float64:
+			ncPutInt(b, ncDouble)
+			ncPutInt(b, 1)
+			binary.Write(b, binary.BigEndian, v)
+		}
+	}
+}
+
+// cfUnits maps the units of weatherColumns to their UDUNITS spelling.
+var cfUnits = map[string]string{
+	"°C":    "degC",
+	"%":     "percent",
+	"mm":    "mm",
+	"hours": "hours",
+	"m/s":   "m s-1",
+	"°":     "degree",
+}
+
+// cfMetadata gives each column its CF standard name and, for daily
+// statistics, the cell method that produced it.
+var cfMetadata = map[string]struct{ StandardName, CellMethods string }{
+	"tn":      {"air_temperature", "time: minimum"},
+	"tx":      {"air_temperature", "time: maximum"},
+	"tavg":    {"air_temperature", "time: mean"},
+	"rh_avg":  {"relative_humidity", "time: mean"},
+	"rr":      {"lwe_thickness_of_precipitation_amount", "time: sum"},
+	"ss":      {"duration_of_sunshine", "time: sum"},
+	"ff_x":    {"wind_speed", "time: maximum"},
+	"ff_avg":  {"wind_speed", "time: mean"},
+	"ddd_x":   {"wind_from_direction", ""},
+	"ddd_car": {"wind_from_direction", ""},
+}
+
+// stationNetCDF packages a station's daily rows as a CF-1.8 dataset on a
+// time × lat × lon grid of a single point, one variable per data type with
+// missing readings set to the fill value. Time counts days since the Unix
+// epoch, matching the station-local calendar days of Tanggal.
+func stationNetCDF(station Station, dataTypes []string, rows []map[string]interface{}) (*ncFile, error) {
+	const (
+		timeDim = iota
+		latDim
+		lonDim
+	)
+	f := &ncFile{
+		Dims: []ncDim{{"time", len(rows)}, {"lat", 1}, {"lon", 1}},
+		Attrs: []ncAttr{
+			{"Conventions", "CF-1.8"},
+			{"title", "Daily observations of station " + strconv.Itoa(station.StationNumber) + " " + station.StationName},
+			{"station_number", int32(station.StationNumber)},
+			{"station_name", station.StationName},
+			{"history", time.Now().UTC().Format(time.RFC3339) + " exported by backend-hujan"},
+		},
+	}
+
+	days := make([]float64, len(rows))
+	for i, row := range rows {
+		day, err := time.Parse("2006-01-02", formatValue(row[dateColumn.Key]))
+		if err != nil {
+			return nil, err
+		}
+		days[i] = float64(day.Unix() / 86400)
+	}
+	f.Vars = append(f.Vars,
+		ncVar{Name: "time", Dims: []int{timeDim}, Data: days, Attrs: []ncAttr{
+			{"standard_name", "time"},
+			{"long_name", "observation date"},
+			{"units", "days since 1970-01-01"},
+			{"calendar", "standard"},
+			{"axis", "T"},
+		}},
+		ncVar{Name: "lat", Dims: []int{latDim}, Data: []float64{station.Latitude}, Attrs: []ncAttr{
+			{"standard_name", "latitude"},
+			{"long_name", "station latitude"},
+			{"units", "degrees_north"},
+			{"axis", "Y"},
+		}},
+		ncVar{Name: "lon", Dims: []int{lonDim}, Data: []float64{station.Longitude}, Attrs: []ncAttr{
+			{"standard_name", "longitude"},
+			{"long_name", "station longitude"},
+			{"units", "degrees_east"},
+			{"axis", "X"},
+		}},
+	)
+	if station.Elevation.Valid {
+		f.Vars = append(f.Vars, ncVar{Name: "alt", Data: []float64{station.Elevation.Float64}, Attrs: []ncAttr{
+			{"standard_name", "height_above_mean_sea_level"},
+			{"long_name", "station elevation"},
+			{"units", "m"},
+			{"positive", "up"},
+		}})
+	}
+
+	for _, t := range dataTypes {
+		col, _ := lookupColumn(t)
+		data := make([]float64, len(rows))
+		for i, row := range rows {
+			data[i] = ncFillDouble
+			if v, ok := toFloat(row[t]); ok {
+				data[i] = v
+			}
+		}
+		attrs := []ncAttr{{"long_name", col.Name}}
+		if units, ok := cfUnits[col.Unit]; ok {
+			attrs = append(attrs, ncAttr{"units", units})
+		}
+		if meta, ok := cfMetadata[t]; ok {
+			attrs = append(attrs, ncAttr{"standard_name", meta.StandardName})
+			if meta.CellMethods != "" {
+				attrs = append(attrs, ncAttr{"cell_methods", meta.CellMethods})
+			}
+		}
+		attrs = append(attrs, ncAttr{"_FillValue", ncFillDouble})
+		f.Vars = append(f.Vars, ncVar{Name: t, Dims: []int{timeDim, latDim, lonDim}, Attrs: attrs, Data: data})
+	}
+	return f, nil
+}
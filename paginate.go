@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxPageSize bounds the limit parameter of paginated listings.
+const maxPageSize = 1000
+
+// page is the slice of a listing a request asks for with limit and offset.
+// A zero Limit means the whole listing, as before pagination.
+type page struct {
+	Limit    int
+	Offset   int
+	Envelope bool
+}
+
+// parsePage reads the limit, offset and envelope parameters.
+func parsePage(values url.Values) (page, error) {
+	var p page
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return page{}, errors.New("limit must be a number between 1 and " + strconv.Itoa(maxPageSize) + ".")
+		}
+		p.Limit = limit
+	}
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return page{}, errors.New("offset must be a non-negative integer.")
+		}
+		p.Offset = offset
+	}
+	switch values.Get("envelope") {
+	case "", "false":
+	case "true":
+		p.Envelope = true
+	default:
+		return page{}, errors.New("envelope must be either true or false.")
+	}
+	return p, nil
+}
+
+// sql returns the LIMIT and OFFSET clause of the page, or an empty string for
+// the whole listing.
+func (p page) sql() string {
+	clause := ""
+	if p.Limit > 0 {
+		clause += " LIMIT " + strconv.Itoa(p.Limit)
+	}
+	if p.Offset > 0 {
+		clause += " OFFSET " + strconv.Itoa(p.Offset)
+	}
+	return clause
+}
+
+// pageMeta describes a page within the full listing of total items.
+type pageMeta struct {
+	Total  int  `json:"total"`
+	Limit  *int `json:"limit"`
+	Offset int  `json:"offset"`
+}
+
+// writePage writes one page of a listing. With envelope=true the items are
+// wrapped as {data, meta}; otherwise the bare array is written, as existing
+// clients expect, and the pagination travels in the X-Total-Count and Link
+// headers.
+func writePage(w http.ResponseWriter, r *http.Request, p page, total int, items interface{}) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if links := pageLinks(r.URL, p, total); links != "" {
+		w.Header().Set("Link", links)
+	}
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link")
+
+	if !p.Envelope {
+		writeJSON(w, r, items)
+		return
+	}
+	meta := pageMeta{Total: total, Offset: p.Offset}
+	if p.Limit > 0 {
+		meta.Limit = &p.Limit
+	}
+	writeJSON(w, r, struct {
+		Data interface{} `json:"data"`
+		Meta pageMeta    `json:"meta"`
+	}{items, meta})
+}
+
+// pageLinks builds the RFC 8288 Link header of a page, with first, prev, next
+// and last relations as they apply. A request without a limit has none.
+func pageLinks(u *url.URL, p page, total int) string {
+	if p.Limit == 0 {
+		return ""
+	}
+	link := func(offset int, rel string) string {
+		values := u.Query()
+		values.Set("limit", strconv.Itoa(p.Limit))
+		values.Set("offset", strconv.Itoa(offset))
+		target := url.URL{Path: u.Path, RawQuery: values.Encode()}
+		return "<" + target.String() + ">; rel=\"" + rel + "\""
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / p.Limit * p.Limit
+	}
+	links := []string{link(0, "first")}
+	if p.Offset > 0 {
+		prev := p.Offset - p.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if p.Offset+p.Limit < total {
+		links = append(links, link(p.Offset+p.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetStream writes weather rows as a Parquet file. Tanggal becomes a
+// date column, categorical derived fields nullable strings, integer columns
+// nullable int64s and every other column a nullable double.
+type parquetStream struct {
+	pw      *writer.CSVWriter
+	columns []string
+}
+
+func newParquetStream(w http.ResponseWriter, columns []string) (*parquetStream, error) {
+	columns = append([]string{dateColumn.Key}, columns...)
+	schema := []string{"name=" + dateColumn.Key + ", type=INT32, convertedtype=DATE, repetitiontype=REQUIRED"}
+	for _, col := range columns[1:] {
+		if isCategorical(col) {
+			schema = append(schema, "name="+col+", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL")
+			continue
+		}
+		if isIntegerColumn(col) {
+			schema = append(schema, "name="+col+", type=INT64, repetitiontype=OPTIONAL")
+			continue
+		}
+		schema = append(schema, "name="+col+", type=DOUBLE, repetitiontype=OPTIONAL")
+	}
+
+	pw, err := writer.NewCSVWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetStream{pw: pw, columns: columns}, nil
+}
+
+func (p *parquetStream) WriteRow(row map[string]interface{}) error {
+	day, err := time.Parse("2006-01-02", formatValue(row[dateColumn.Key]))
+	if err != nil {
+		return err
+	}
+	// Parquet dates count the days since the Unix epoch
+	record := []interface{}{int32(day.Unix() / 86400)}
+	for _, col := range p.columns[1:] {
+		var value interface{}
+		if label, ok := row[col].(string); ok && isCategorical(col) {
+			value = label
+		} else if f, ok := toFloat(row[col]); ok && isIntegerColumn(col) {
+			value = int64(f)
+		} else if ok {
+			value = f
+		}
+		record = append(record, value)
+	}
+	return p.pw.Write(record)
+}
+
+// Close writes the buffered rows and the file footer.
+func (p *parquetStream) Close() error {
+	return p.pw.WriteStop()
+}
+
+// isCategorical reports whether col is a derived field with categories.
+func isCategorical(col string) bool {
+	f, ok := lookupDerived(col)
+	return ok && len(f.Categories) > 0
+}
+
+// isIntegerColumn reports whether col is a stored column of whole numbers.
+func isIntegerColumn(col string) bool {
+	c, ok := lookupColumn(col)
+	return ok && c.Integer
+}
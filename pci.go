@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pciCategories classify the Precipitation Concentration Index after Oliver
+// (1980): from the uniform 8.3 of equal monthly totals up to 100 for a year
+// whose rain all fell in one month.
+var pciCategories = []fieldCategory{
+	{Label: "uniform", Max: bound(10)},
+	{Label: "moderate_concentration", Min: bound(10), Max: bound(15)},
+	{Label: "irregular", Min: bound(15), Max: bound(20)},
+	{Label: "strong_irregularity", Min: bound(20)},
+}
+
+// handlePCI computes a station's Precipitation Concentration Index for a
+// year, 100 times the sum of the squared monthly rainfall totals over the
+// squared annual total. The index needs all twelve months, each with rr on
+// at least 80% of its days as for /aggregate/spi; otherwise the months
+// falling short are listed instead.
+func (s *server) handlePCI(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(values.Get("year"))
+	if err != nil || year < 1 || year > 9999 {
+		httpError(w, r, "Invalid request. year must be a four digit year.", http.StatusBadRequest)
+		return
+	}
+
+	months, totals, _, err := s.monthlyRainfall(r.Context(), stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Months outside the station's record are as missing as incomplete ones
+	monthly := make([]*float64, 12)
+	for i, m := range months {
+		if m.Year() == year && !math.IsNaN(totals[i]) {
+			total := totals[i]
+			monthly[m.Month()-1] = &total
+		}
+	}
+	missing := []string{}
+	var sum, squares float64
+	for i, total := range monthly {
+		if total == nil {
+			missing = append(missing, time.Date(year, time.Month(i+1), 1, 0, 0, 0, 0, stationTZ).Format("2006-01"))
+			continue
+		}
+		sum += *total
+		squares += *total * *total
+	}
+
+	result := struct {
+		StationNumber string      `json:"station_number"`
+		Year          int         `json:"year"`
+		Status        string      `json:"status"`
+		Monthly       []*float64  `json:"monthly_totals"`
+		Annual        *float64    `json:"annual_total"`
+		PCI           *float64    `json:"pci"`
+		Class         interface{} `json:"class"`
+		Missing       []string    `json:"missing_months"`
+	}{StationNumber: stationNumber, Year: year, Status: "insufficient_data", Monthly: monthly, Missing: missing}
+
+	if len(missing) == 0 {
+		result.Status = "ok"
+		result.Annual = &sum
+		// A year without rain has no concentration to speak of
+		if sum > 0 {
+			pci := 100 * squares / (sum * sum)
+			result.PCI = &pci
+			result.Class = classify(pciCategories, pci)
+		}
+	}
+
+	writeJSON(w, r, result)
+}
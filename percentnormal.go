@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// percentNormalMinCoverage is the fraction of days a year's calendar period
+// needs rr readings on for its total to count toward the normal.
+const percentNormalMinCoverage = 0.8
+
+// handlePercentOfNormal compares the rainfall total over a date range with
+// the normal total of the same calendar period: the mean of that period's
+// totals in the other years of the baseline, given as baseline=YYYY-YYYY and
+// all years on record by default. A range running past the new year, such as
+// a November to February wet season, is matched the same way. Years need 80%
+// of the period's days recorded to count, and minYears of them are needed
+// for a normal. When there is no normal, or it is zero, percent is null and
+// reason tells why.
+func (s *server) handlePercentOfNormal(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if endDate.After(startDate.AddDate(1, 0, -1)) {
+		httpError(w, r, "Invalid request. dateRange must span at most one year.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	firstYear, lastYear := 1, 9999
+	if v := values.Get("baseline"); v != "" {
+		from, to, found := strings.Cut(v, "-")
+		firstYear, err = strconv.Atoi(from)
+		if err == nil && found {
+			lastYear, err = strconv.Atoi(to)
+		}
+		if err != nil || !found || firstYear > lastYear {
+			httpError(w, r, "Invalid request. baseline must be a range of years such as 1991-2020.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The period is matched on its MM-DD days; when it wraps past the new
+	// year, days before the start belong to the season begun the year before
+	startDay, endDay := startDate.Format("01-02"), endDate.Format("01-02")
+	wraps := startDay > endDay
+	calendarDays := "SUBSTRING(\"Tanggal\", 6, 5) BETWEEN $2 AND $3"
+	if wraps {
+		calendarDays = "(SUBSTRING(\"Tanggal\", 6, 5) >= $2 OR SUBSTRING(\"Tanggal\", 6, 5) <= $3)"
+	}
+	rows, err := s.db.QueryContext(r.Context(), "SELECT SUBSTRING(\"Tanggal\", 1, 10), rr FROM \"Weather\" WHERE station_number = $1 AND rr IS NOT NULL AND "+calendarDays,
+		stationNumber, startDay, endDay)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	totals := map[int]float64{}
+	counts := map[int]int{}
+	for rows.Next() {
+		var tanggal string
+		var rr float64
+		if err := rows.Scan(&tanggal, &rr); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		day, err := time.ParseInLocation("2006-01-02", tanggal, stationTZ)
+		if err != nil {
+			continue
+		}
+		season := day.Year()
+		if wraps && day.Format("01-02") < startDay {
+			season--
+		}
+		totals[season] += rr
+		counts[season]++
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	expected := daysBetween(startDate, endDate)
+	target := startDate.Year()
+
+	result := struct {
+		StationNumber string   `json:"station_number"`
+		StartDate     string   `json:"start_date"`
+		EndDate       string   `json:"end_date"`
+		Total         *float64 `json:"total"`
+		Normal        *float64 `json:"normal"`
+		NormalYears   int      `json:"normal_years"`
+		Baseline      *string  `json:"baseline"`
+		MinYears      int      `json:"min_years"`
+		Percent       *float64 `json:"percent"`
+		Reason        *string  `json:"reason"`
+		dataCoverage
+	}{
+		StationNumber: stationNumber,
+		StartDate:     startDate.Format("2006-01-02"),
+		EndDate:       endDate.Format("2006-01-02"),
+		MinYears:      minYears,
+		dataCoverage:  newDataCoverage(counts[target], expected),
+	}
+	if v := values.Get("baseline"); v != "" {
+		result.Baseline = &v
+	}
+	if counts[target] > 0 {
+		total := totals[target]
+		result.Total = &total
+	}
+
+	var sum float64
+	for season, n := range counts {
+		if season == target || season < firstYear || season > lastYear || float64(n) < percentNormalMinCoverage*float64(expected) {
+			continue
+		}
+		sum += totals[season]
+		result.NormalYears++
+	}
+
+	reason := ""
+	switch {
+	case result.NormalYears < minYears:
+		reason = "insufficient_history"
+	case sum == 0:
+		// Perfectly dry normals make any rain an infinite percentage
+		normal := 0.0
+		result.Normal = &normal
+		reason = "zero_normal"
+	default:
+		normal := sum / float64(result.NormalYears)
+		result.Normal = &normal
+		if result.Total == nil {
+			reason = "no_data"
+			break
+		}
+		percent := *result.Total / normal * 100
+		result.Percent = &percent
+	}
+	if reason != "" {
+		result.Reason = &reason
+	}
+
+	writeJSON(w, r, result)
+}
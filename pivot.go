@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pivotYear is one row of a year-by-month table.
+type pivotYear struct {
+	Year   int        `json:"year"`
+	Months []*float64 `json:"months"`
+	Annual *float64   `json:"annual"`
+
+	// Days counts the readings behind each month
+	Days [12]int `json:"days"`
+}
+
+// handleYearMonthPivot returns a station's classic climate table of one
+// column: a row per year from the first to the last with data, and twelve
+// monthly values, the mean with agg=avg or the total with agg=sum. agg
+// defaults to sum for rr and avg for the rest. A month is null unless at
+// least 80% of its days have a reading, and the annual value, the mean or
+// total of the twelve months, is null unless every month has one.
+func (s *server) handleYearMonthPivot(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agg := values.Get("agg")
+	if agg == "" {
+		agg = "avg"
+		if dataType == "rr" {
+			agg = "sum"
+		}
+	}
+	if agg != "avg" && agg != "sum" {
+		httpError(w, r, "Invalid request. agg must be either avg or sum.", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT SUBSTRING(\"Tanggal\", 1, 7), "+agg+"(\""+dataType+"\"), COUNT(\""+dataType+"\") FROM \"Weather\" WHERE station_number = $1 AND \""+dataType+"\" IS NOT NULL GROUP BY 1 ORDER BY 1",
+		stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Months arrive in order, so a new year starts a new row and the years
+	// in between without data get empty rows
+	years := []*pivotYear{}
+	for rows.Next() {
+		var month string
+		var value float64
+		var count int
+		if err := rows.Scan(&month, &value, &count); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		start, err := time.ParseInLocation("2006-01", month, stationTZ)
+		if err != nil {
+			continue
+		}
+		for len(years) == 0 || years[len(years)-1].Year < start.Year() {
+			year := start.Year()
+			if len(years) > 0 {
+				year = years[len(years)-1].Year + 1
+			}
+			years = append(years, &pivotYear{Year: year, Months: make([]*float64, 12)})
+		}
+		row := years[len(years)-1]
+		row.Days[start.Month()-1] = count
+		if float64(count) >= monthMinCoverage*float64(start.AddDate(0, 1, -1).Day()) {
+			row.Months[start.Month()-1] = &value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	for _, row := range years {
+		annual := 0.0
+		complete := true
+		for _, v := range row.Months {
+			if v == nil {
+				complete = false
+				break
+			}
+			annual += *v
+		}
+		if complete {
+			if agg == "avg" {
+				annual /= 12
+			}
+			row.Annual = &annual
+		}
+	}
+
+	column, _ := lookupColumn(dataType)
+	writeJSON(w, r, struct {
+		StationNumber string       `json:"station_number"`
+		Type          string       `json:"type"`
+		Unit          string       `json:"unit"`
+		Agg           string       `json:"agg"`
+		Years         []*pivotYear `json:"years"`
+	}{stationNumber, dataType, column.Unit, agg, years})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// qcFlagColumn describes the optional quality-control flag of a reading. Not
+// every database has it, so it is only selected when detectQCFlag found it.
+var qcFlagColumn = weatherColumn{Key: "qc_flag", Name: "Quality Flag", Description: "Quality-control score of the reading, higher is better. Only present on databases with the column."}
+
+// detectQCFlag reports whether the Weather table has a qc_flag column.
+func detectQCFlag(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'Weather' AND column_name = 'qc_flag')").Scan(&exists)
+	return exists, err
+}
+
+// parseMinQuality validates the minQuality parameter. It needs the qc_flag
+// column, so it is rejected on databases without one rather than silently
+// returning unfiltered readings.
+func (s *server) parseMinQuality(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if _, err := strconv.ParseFloat(v, 64); err != nil {
+		return "", errors.New("minQuality must be a number.")
+	}
+	if !s.qcFlag {
+		return "", errors.New("minQuality is not supported, the Weather table has no qc_flag column.")
+	}
+	return v, nil
+}
+
+// qualityColumns returns the column keys to append to row output for the
+// quality flag: qc_flag when the database has it, nothing otherwise.
+func (s *server) qualityColumns() []string {
+	if s.qcFlag {
+		return []string{qcFlagColumn.Key}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// handleLongestRecords ranks the stations by the length of their record:
+// by default the span from the first to the last observation, or with
+// by=count the number of observations. limit, 10 by default, sets how many
+// are returned.
+func (s *server) handleLongestRecords(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	limit := 10
+	if v := values.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			httpError(w, r, "Invalid request. limit must be a number between 1 and "+strconv.Itoa(maxPageSize)+".", http.StatusBadRequest)
+			return
+		}
+	}
+
+	order := "span_days DESC, records DESC"
+	switch values.Get("by") {
+	case "", "span":
+	case "count":
+		order = "records DESC, span_days DESC"
+	default:
+		httpError(w, r, "Invalid request. by must be either span or count.", http.StatusBadRequest)
+		return
+	}
+
+	// Tanggal holds YYYY-MM-DD text, so its extremes are the first and last
+	// days without parsing every row
+	rows, err := s.db.QueryContext(r.Context(), "SELECT s.station_number, s.station_name, first_day, last_day, TO_DATE(last_day, 'YYYY-MM-DD') - TO_DATE(first_day, 'YYYY-MM-DD') + 1 AS span_days, records FROM \"Station\" s JOIN (SELECT station_number, SUBSTRING(MIN(\"Tanggal\"), 1, 10) AS first_day, SUBSTRING(MAX(\"Tanggal\"), 1, 10) AS last_day, COUNT(*) AS records FROM \"Weather\" GROUP BY station_number) w ON w.station_number = s.station_number ORDER BY "+order+", s.station_number LIMIT $1",
+		limit)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type stationRecord struct {
+		StationNumber int    `json:"station_number"`
+		StationName   string `json:"station_name"`
+		FirstDate     string `json:"first_date"`
+		LastDate      string `json:"last_date"`
+		SpanDays      int    `json:"span_days"`
+		Records       int    `json:"records"`
+	}
+	stations := []stationRecord{}
+	for rows.Next() {
+		var st stationRecord
+		if err := rows.Scan(&st.StationNumber, &st.StationName, &st.FirstDate, &st.LastDate, &st.SpanDays, &st.Records); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		stations = append(stations, st)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, stations)
+}
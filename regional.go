@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRegionalStations caps the stations blended into one regional average.
+const maxRegionalStations = 50
+
+// regionalDay is the regional average of one day and the number of stations
+// it was blended from.
+type regionalDay struct {
+	Date     string   `json:"date"`
+	Value    *float64 `json:"value"`
+	Stations int      `json:"stations"`
+}
+
+// handleRegional blends the daily values of one column at several stations
+// into a regional series, weighting each station by its entry in weights,
+// e.g. its share of the region's area, or equally without them. On a day
+// some stations did not report, the weights of those that did are
+// renormalized to sum to one, so a missing station neither drags the value
+// towards zero nor leaves the day out; n counts the days with a value. Wind
+// directions are rejected, as they cannot be averaged linearly.
+func (s *server) handleRegional(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	dataType := values.Get("type")
+
+	var numbers []interface{}
+	var placeholders []string
+	seen := map[int]bool{}
+	for _, n := range strings.Split(values.Get("stations"), ",") {
+		number, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil {
+			httpError(w, r, "Invalid request. stations must be a comma-separated list of station numbers.", http.StatusBadRequest)
+			return
+		}
+		if seen[number] {
+			httpError(w, r, "Invalid request. Station "+strconv.Itoa(number)+" is listed more than once.", http.StatusBadRequest)
+			return
+		}
+		seen[number] = true
+		numbers = append(numbers, number)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(numbers)))
+	}
+	if len(numbers) > maxRegionalStations {
+		httpError(w, r, "Invalid request. At most "+strconv.Itoa(maxRegionalStations)+" stations can be blended at once.", http.StatusBadRequest)
+		return
+	}
+
+	column, ok := lookupColumn(dataType)
+	if !ok || !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	weights := map[int]float64{}
+	if v := values.Get("weights"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != len(numbers) {
+			httpError(w, r, "Invalid request. weights must list one weight per station.", http.StatusBadRequest)
+			return
+		}
+		total := 0.0
+		for i, p := range parts {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || weight < 0 {
+				httpError(w, r, "Invalid request. weights must be non-negative numbers.", http.StatusBadRequest)
+				return
+			}
+			weights[numbers[i].(int)] = weight
+			total += weight
+		}
+		if total == 0 {
+			httpError(w, r, "Invalid request. weights must not all be zero.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, n := range numbers {
+			weights[n.(int)] = 1
+		}
+	}
+
+	args := append(numbers, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	rows, err := s.db.QueryContext(r.Context(), "SELECT station_number, \"Tanggal\", \""+dataType+"\" FROM \"Weather\" WHERE station_number IN ("+strings.Join(placeholders, ", ")+") AND \"Tanggal\" BETWEEN $"+strconv.Itoa(len(numbers)+1)+" AND $"+strconv.Itoa(len(numbers)+2)+" AND \""+dataType+"\" IS NOT NULL",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// A station's readings are keyed by day, so duplicate rows count once
+	readings := map[string]map[int]float64{}
+	for rows.Next() {
+		var number int
+		var tanggal string
+		var value float64
+		if err := rows.Scan(&number, &tanggal, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if readings[tanggal] == nil {
+			readings[tanggal] = map[int]float64{}
+		}
+		readings[tanggal][number] = value
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	days := []regionalDay{}
+	blended := 0
+	for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		d := regionalDay{Date: day.Format("2006-01-02")}
+		var sum, weightSum float64
+		for _, n := range numbers {
+			value, ok := readings[d.Date][n.(int)]
+			if !ok {
+				continue
+			}
+			sum += weights[n.(int)] * value
+			weightSum += weights[n.(int)]
+			d.Stations++
+		}
+		// Stations weighted zero report without moving the value
+		if weightSum > 0 {
+			value := sum / weightSum
+			d.Value = &value
+			blended++
+		}
+		days = append(days, d)
+	}
+
+	stations := make([]int, len(numbers))
+	stationWeights := make([]float64, len(numbers))
+	for i, n := range numbers {
+		stations[i], stationWeights[i] = n.(int), weights[n.(int)]
+	}
+	writeJSON(w, r, struct {
+		Stations []int         `json:"stations"`
+		Weights  []float64     `json:"weights"`
+		Type     string        `json:"type"`
+		Unit     string        `json:"unit"`
+		Days     []regionalDay `json:"days"`
+		dataCoverage
+	}{stations, stationWeights, dataType, column.Unit, days,
+		newDataCoverage(blended, daysBetween(startDate, endDate))})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errResponseTooLarge reports that a response would exceed the
+// MAX_RESPONSE_BYTES cap on JSON responses. Streamed formats are not held in
+// memory and so are not capped.
+var errResponseTooLarge = errors.New("response exceeds MAX_RESPONSE_BYTES")
+
+// responseTooLarge answers a request whose response would exceed
+// MAX_RESPONSE_BYTES.
+func responseTooLarge(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusUnprocessableEntity, "response_too_large",
+		"The response would exceed "+strconv.Itoa(config.MaxResponseBytes)+" bytes. Narrow the date range, request fewer types, paginate with limit and offset, or use format=csv, which is streamed.")
+}
+
+// writeJSON serializes v as the JSON response body. Output is compact unless
+// the request asks for pretty=true. With naming=camel the snake_case keys are
+// rewritten to camelCase, e.g. station_number to stationNumber.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with an explicit status code.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jsonData, err := json.Marshal(v)
+	if err == nil && r.URL.Query().Get("naming") == "camel" {
+		jsonData, err = camelKeys(jsonData)
+	}
+	if err == nil && r.URL.Query().Get("pretty") == "true" {
+		var indented bytes.Buffer
+		err = json.Indent(&indented, jsonData, "", "  ")
+		jsonData = indented.Bytes()
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if config.MaxResponseBytes > 0 && len(jsonData) > config.MaxResponseBytes {
+		responseTooLarge(w, r)
+		return
+	}
+
+	// Set the Content-Type, unless the handler chose a more specific JSON
+	// type, and Content-Length headers, the latter so HEAD requests learn the
+	// size too, and write the JSON response
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+// camelCase converts a snake_case key to camelCase. Keys without
+// underscores, such as Tanggal, are left alone.
+func camelCase(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// camelKeys rewrites every object key in a JSON document with camelCase.
+// It walks the token stream rather than decoding into maps, so the keys keep
+// their order and numbers their exact text.
+func camelKeys(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out bytes.Buffer
+	// Each open object or array on the stack tracks whether the next token
+	// is an object key and whether a separator is due before it
+	type level struct {
+		object, expectKey, needComma bool
+	}
+	var stack []level
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		isKey := false
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			closing := tok == json.Delim('}') || tok == json.Delim(']')
+			if !closing {
+				if top.needComma && (!top.object || top.expectKey) {
+					out.WriteByte(',')
+				}
+				isKey = top.object && top.expectKey
+				if top.object {
+					top.expectKey = !top.expectKey
+				}
+				top.needComma = true
+			}
+		}
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			out.WriteRune(rune(tok))
+			switch tok {
+			case '{':
+				stack = append(stack, level{object: true, expectKey: true})
+			case '[':
+				stack = append(stack, level{})
+			default:
+				stack = stack[:len(stack)-1]
+			}
+		case string:
+			if isKey {
+				tok = camelCase(tok)
+			}
+			encoded, _ := json.Marshal(tok)
+			out.Write(encoded)
+			if isKey {
+				out.WriteByte(':')
+			}
+		default:
+			encoded, _ := json.Marshal(tok)
+			out.Write(encoded)
+		}
+	}
+}
+
+// apiError is the JSON body of an error response.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError answers with an error in the representation the request's
+// Accept header prefers: the JSON error object for clients asking for JSON,
+// and the bare message as plain text for everyone else, curl's */* included,
+// so terminal output stays readable. It writes the body directly, as the
+// error may stem from serializing the regular response.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add("Vary", "Accept")
+
+	if !prefersJSON(r.Header.Get("Accept")) {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		io.WriteString(w, message+"\n")
+		return
+	}
+
+	jsonData, _ := json.Marshal(struct {
+		Error apiError `json:"error"`
+	}{apiError{code, message}})
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+// prefersJSON reports whether an Accept header ranks JSON above text. JSON
+// is application/json, any +json type or application/*; wildcards and
+// missing headers fall to text.
+func prefersJSON(accept string) bool {
+	var jsonQ, textQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch {
+		case mediaType == "application/json" || mediaType == "application/*" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = math.Max(jsonQ, q)
+		case strings.HasPrefix(mediaType, "text/") || mediaType == "*/*":
+			textQ = math.Max(textQ, q)
+		}
+	}
+	return jsonQ > textQ
+}
+
+// httpError is http.Error with content negotiation, the error code being
+// derived from the status, e.g. not_found for 404.
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	writeError(w, r, status, code, message)
+}
+
+// serverError logs err and answers with a generic 500, or with 504 when the
+// error stems from the request running out of its REQUEST_TIMEOUT budget.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println(err)
+	if r.Context().Err() == context.DeadlineExceeded {
+		writeError(w, r, http.StatusGatewayTimeout, "request_timeout",
+			"The request took longer than its budget of "+config.RequestTimeout.String()+". Narrow the date range or request fewer types.")
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error.")
+}
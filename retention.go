@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// handleDeleteWeather removes the observations of a station dated before a
+// day, for keeping the Weather table to a retention window. With
+// archive=true the rows move to "WeatherArchive" instead of being dropped.
+// As a guard against mass deletion by a stray request, confirm must repeat
+// the station number.
+func (s *server) handleDeleteWeather(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	day, err := parseDate(values.Get("before"))
+	if err != nil {
+		httpError(w, r, "Invalid request. Invalid before, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	before := day.Format("2006-01-02")
+
+	archive := values.Get("archive") == "true"
+
+	if values.Get("confirm") != stationNumber {
+		httpError(w, r, "Invalid request. confirm must repeat the stationNumber to delete its observations.", http.StatusBadRequest)
+		return
+	}
+
+	query := "DELETE FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" < $2"
+	if archive {
+		query = "WITH moved AS (" + query + " RETURNING *) INSERT INTO \"WeatherArchive\" SELECT * FROM moved"
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), query, stationNumber, before)
+	var pqErr *pq.Error
+	if archive && errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		httpError(w, r, "Invalid request. archive=true needs the WeatherArchive table; apply the migrations first.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	action := "deleted"
+	if archive {
+		action = "archived"
+	}
+	log.Printf("RETENTION: %s %d Weather rows of station %s dated before %s, requested by %s", action, deleted, stationNumber, before, r.RemoteAddr)
+	if deleted > 0 {
+		s.cache.invalidateStation(stationNumber)
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string `json:"station_number"`
+		Before        string `json:"before"`
+		Archived      bool   `json:"archived"`
+		Deleted       int64  `json:"deleted"`
+	}{stationNumber, before, archive, deleted})
+}
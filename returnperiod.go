@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// returnPeriods are the return periods, in years, that rainfall depths are
+// estimated for.
+var returnPeriods = []int{2, 5, 10, 25, 50, 100}
+
+// annualMaxMinCoverage is the fraction of days in a year that need an rr
+// reading for its maximum to count; in sparser years the true maximum may
+// well be missing.
+const annualMaxMinCoverage = 0.8
+
+// eulerGamma is the Euler-Mascheroni constant, the mean of the standard
+// Gumbel distribution.
+const eulerGamma = 0.5772156649015329
+
+// handleReturnPeriod estimates the daily rainfall depths of standard return
+// periods from a Gumbel distribution fitted, by the method of moments, to the
+// station's annual maximum daily rr. Years with fewer than 80% of days
+// recorded are left out, and without minYears remaining years no fit is
+// made; each maximum reports the coverage of its year. The depth of return
+// period T is the one exceeded with probability 1/T in any year.
+func (s *server) handleReturnPeriod(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	minYears, ok := parseMinYears(values.Get("minYears"))
+	if !ok {
+		httpError(w, r, "Invalid request. minYears must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT SUBSTRING(\"Tanggal\", 1, 4), MAX(rr), COUNT(rr) FROM \"Weather\" WHERE station_number = $1 AND rr IS NOT NULL GROUP BY 1 ORDER BY 1",
+		stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type annualMax struct {
+		Year    string  `json:"year"`
+		Maximum float64 `json:"maximum"`
+		dataCoverage
+	}
+	maxima := []annualMax{}
+	for rows.Next() {
+		var m annualMax
+		if err := rows.Scan(&m.Year, &m.Maximum, &m.N); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		year, err := strconv.Atoi(m.Year)
+		if err != nil {
+			continue
+		}
+		days := time.Date(year, time.December, 31, 0, 0, 0, 0, stationTZ).YearDay()
+		m.dataCoverage = newDataCoverage(m.N, days)
+		if float64(m.N) >= annualMaxMinCoverage*float64(days) {
+			maxima = append(maxima, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	type gumbelFit struct {
+		Location float64 `json:"location"`
+		Scale    float64 `json:"scale"`
+	}
+	type returnDepth struct {
+		ReturnPeriod int     `json:"return_period"`
+		Depth        float64 `json:"depth"`
+	}
+	result := struct {
+		StationNumber string        `json:"station_number"`
+		Unit          string        `json:"unit"`
+		MinYears      int           `json:"min_years"`
+		Years         int           `json:"years"`
+		Status        string        `json:"status"`
+		Fit           *gumbelFit    `json:"fit"`
+		Depths        []returnDepth `json:"depths"`
+		AnnualMaxima  []annualMax   `json:"annual_maxima"`
+	}{
+		StationNumber: stationNumber,
+		Unit:          "mm",
+		MinYears:      minYears,
+		Years:         len(maxima),
+		Status:        "insufficient_history",
+		Depths:        []returnDepth{},
+		AnnualMaxima:  maxima,
+	}
+
+	if len(maxima) >= minYears && len(maxima) >= 2 {
+		var sum, sumSquares float64
+		for _, m := range maxima {
+			sum += m.Maximum
+		}
+		mean := sum / float64(len(maxima))
+		for _, m := range maxima {
+			sumSquares += (m.Maximum - mean) * (m.Maximum - mean)
+		}
+		stddev := math.Sqrt(sumSquares / float64(len(maxima)-1))
+
+		scale := stddev * math.Sqrt(6) / math.Pi
+		fit := gumbelFit{Location: mean - eulerGamma*scale, Scale: scale}
+		result.Fit = &fit
+		result.Status = "ok"
+		for _, t := range returnPeriods {
+			depth := fit.Location - fit.Scale*math.Log(-math.Log(1-1/float64(t)))
+			result.Depths = append(result.Depths, returnDepth{t, depth})
+		}
+	}
+
+	writeJSON(w, r, result)
+}
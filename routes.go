@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// server holds the dependencies shared by the HTTP handlers.
+type server struct {
+	db       *queryDB
+	exports  *exportStore
+	readOnly atomic.Bool
+
+	// qcFlag reports whether the Weather table has the optional qc_flag column
+	qcFlag bool
+
+	// monthlySummary reports whether the weather_monthly_summary view exists
+	monthlySummary atomic.Bool
+
+	// cache holds recent aggregate responses; nil disables caching
+	cache *responseCache
+}
+
+// route describes one endpoint. The registry returned by routes is the single
+// source for both the mux and the API index.
+type route struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	Admin       bool     `json:"admin,omitempty"`
+	Writes      bool     `json:"writes,omitempty"`
+
+	// Feature names the flag that disables the route through
+	// DISABLED_ENDPOINTS; routes without one cannot be disabled.
+	Feature string `json:"feature,omitempty"`
+
+	// Stream marks long-lived responses, which are exempt from
+	// REQUEST_TIMEOUT, MAX_CONCURRENT and compression.
+	Stream bool `json:"stream,omitempty"`
+
+	handler http.HandlerFunc
+}
+
+func (s *server) routes() []route {
+	return []route{
+		{Path: "/", Methods: []string{"GET"}, Description: "Index of the available endpoints.", handler: s.handleIndex},
+		{Path: "/healthz", Methods: []string{"GET"}, Description: "Liveness, database reachability and read-only mode.", handler: s.handleHealthz},
+		{Path: "/readyz", Methods: []string{"GET"}, Description: "Readiness: database reachability and whether the newest observation is within DATA_FRESHNESS_HOURS.", handler: s.handleReadyz},
+		{Path: "/schema", Methods: []string{"GET"}, Description: "Queryable weather columns and derived fields with their labels, units and category thresholds.", Feature: "schema", handler: s.handleSchema},
+		{Path: "/stations", Methods: []string{"GET"}, Description: "All weather stations, or with include or exclude only some; paginated with limit and offset, wrapped as {data, meta} with envelope=true.", Feature: "stations", handler: s.handleStations},
+		{Path: "/stations/distances", Methods: []string{"GET"}, Description: "Matrix of haversine distances in km between the listed stations, or all of them.", Feature: "stations", handler: s.handleDistances},
+		{Path: "/stations/longest-records", Methods: []string{"GET"}, Description: "Stations ranked by the span of their record, or by=count its number of observations.", Feature: "stations", handler: s.handleLongestRecords},
+		{Path: "/stations/", Methods: []string{"PATCH"}, Description: "Update some fields of the station at /stations/{id}; an explicit null clears the elevation.", Admin: true, Writes: true, Feature: "stations", handler: s.handlePatchStation},
+		{Path: "/input/data", Methods: []string{"GET"}, Description: "Weather observations for a station over a date range as JSON, format=csv, format=tsv, format=parquet or format=influx line protocol. sparse=true omits NULL columns from each row; includeStation=true wraps the data with its station; layout=series groups it per type with units; baseline=mean|median|<number> returns departures; minQuality drops readings with a lower qc_flag; columns keep the requested order, Tanggal last with dateFirst=false; resolution=N downsamples to about N points.", Feature: "data", handler: s.handleInputData},
+		{Path: "/input/data/batch", Methods: []string{"POST"}, Description: "Insert a JSON array of Weather records atomically, reporting failures by index.", Admin: true, Writes: true, Feature: "data", handler: s.handleBatchInsert},
+		{Path: "/validate/query", Methods: []string{"POST"}, Description: "Validate /input/data parameters, including that the station exists, without fetching any data.", Feature: "data", handler: s.handleValidateQuery},
+		{Path: "/weather/anomaly-vs-normal", Methods: []string{"GET"}, Description: "Period average compared against the same calendar days in other years.", Feature: "weather", handler: s.handleAnomalyVsNormal},
+		{Path: "/weather/standardized", Methods: []string{"GET"}, Description: "Z-scores of a column against the station's long-term mean and standard deviation, per calendar month with deseasonalize=true.", Feature: "weather", handler: s.handleStandardized},
+		{Path: "/weather/correlation-matrix", Methods: []string{"GET"}, Description: "Pairwise Pearson correlations between a station's columns over a date range, each over the days both have values.", Feature: "weather", handler: s.handleCorrelationMatrix},
+		{Path: "/weather/rain-categories", Methods: []string{"GET"}, Description: "Daily rainfall classified into BMKG intensity categories.", Feature: "weather", handler: s.handleRainCategories},
+		{Path: "/weather/records-timeline", Methods: []string{"GET"}, Description: "Every day that set a new all-time high, or with extreme=min low, of a column.", Feature: "weather", handler: s.handleRecordsTimeline},
+		{Path: "/weather/duplicates", Methods: []string{"GET"}, Description: "Days on which a station has more than one Weather row.", Feature: "weather", handler: s.handleDuplicates},
+		{Path: "/weather/snapshot", Methods: []string{"GET"}, Description: "One column on one date at every station with its coordinates, as JSON or format=geojson.", Feature: "weather", handler: s.handleSnapshot},
+		{Path: "/weather/calendar", Methods: []string{"GET"}, Description: "A year of one column grouped by week and weekday for a calendar heatmap, with its min and max.", Feature: "weather", handler: s.handleCalendar},
+		{Path: "/weather/heatwaves", Methods: []string{"GET"}, Description: "Runs of consecutive days with tx at or above a threshold, or with kind=cold tn below one.", Feature: "weather", handler: s.handleHeatwaves},
+		{Path: "/weather/stream", Methods: []string{"GET"}, Description: "Server-sent events of a station's newest observation and every one after it.", Feature: "weather", Stream: true, handler: s.handleStream},
+		{Path: "/aggregate/monthly", Methods: []string{"GET"}, Description: "Monthly means and totals, served from the precomputed summary where a month is covered in full; where=rr>1 restricts the days aggregated.", Feature: "aggregate", handler: s.handleMonthly},
+		{Path: "/aggregate/sunshine", Methods: []string{"GET"}, Description: "Sunshine hours and percentage of possible sunshine per interval.", Feature: "aggregate", handler: s.handleSunshine},
+		{Path: "/aggregate/threshold", Methods: []string{"GET"}, Description: "Days on which a column crosses a threshold, e.g. frost days.", Feature: "aggregate", handler: s.handleThreshold},
+		{Path: "/aggregate/tropical-nights", Methods: []string{"GET"}, Description: "ETCCDI tropical nights, the days with tn above a threshold, optionally per month or year.", Feature: "aggregate", handler: s.handleTropicalNights},
+		{Path: "/aggregate/regional", Methods: []string{"GET"}, Description: "Weighted daily average of a column across stations, renormalizing the weights over those reporting each day.", Feature: "aggregate", handler: s.handleRegional},
+		{Path: "/aggregate/cdd-cwd", Methods: []string{"GET"}, Description: "ETCCDI consecutive dry and wet days of a year, with the dates of the longest spells.", Feature: "aggregate", handler: s.handleCDDCWD},
+		{Path: "/aggregate/diurnal", Methods: []string{"GET"}, Description: "Mean value per hour of day, for stations with sub-daily observations.", Feature: "aggregate", handler: s.handleDiurnal},
+		{Path: "/aggregate/et0", Methods: []string{"GET"}, Description: "Daily FAO-56 reference evapotranspiration, falling back to Hargreaves when humidity, wind or sunshine is missing.", Feature: "aggregate", handler: s.handleET0},
+		{Path: "/aggregate/gsl", Methods: []string{"GET"}, Description: "ETCCDI growing season length for a year.", Feature: "aggregate", handler: s.handleGSL},
+		{Path: "/aggregate/wind", Methods: []string{"GET"}, Description: "Vector mean wind direction and speed per interval.", Feature: "aggregate", handler: s.handleWind},
+		{Path: "/aggregate/spi", Methods: []string{"GET"}, Description: "Standardized Precipitation Index series over scale months, fitted to the full rainfall history.", Feature: "aggregate", handler: s.handleSPI},
+		{Path: "/aggregate/spei", Methods: []string{"GET"}, Description: "Standardized Precipitation-Evapotranspiration Index series over scale months, from rr minus ET0 fitted to a generalized logistic distribution.", Feature: "aggregate", handler: s.handleSPEI},
+		{Path: "/aggregate/return-period", Methods: []string{"GET"}, Description: "Daily rainfall depths for 2 to 100 year return periods from a Gumbel fit to the annual maxima.", Feature: "aggregate", handler: s.handleReturnPeriod},
+		{Path: "/climatology/normals", Methods: []string{"GET"}, Description: "Monthly climate normals of tavg, rr and rh_avg over all years on record.", Feature: "climatology", handler: s.handleNormals},
+		{Path: "/climatology/walter-lieth", Methods: []string{"GET"}, Description: "Walter-Lieth climate diagram data: monthly normals with the arid and humid periods.", Feature: "climatology", handler: s.handleWalterLieth},
+		{Path: "/climatology/aridity", Methods: []string{"GET"}, Description: "De Martonne aridity index and Thornthwaite moisture index from the monthly normals, with their climate classes.", Feature: "climatology", handler: s.handleAridity},
+		{Path: "/climatology/frost-dates", Methods: []string{"GET"}, Description: "Last spring and first autumn frost per year, with the frost-free period between them.", Feature: "climatology", handler: s.handleFrostDates},
+		{Path: "/climatology/monsoon-onset", Methods: []string{"GET"}, Description: "Onset date of the rainy season starting in a year, by a configurable rainfall criterion.", Feature: "climatology", handler: s.handleMonsoonOnset},
+		{Path: "/climatology/percent-of-normal", Methods: []string{"GET"}, Description: "Rainfall over a date range as a percentage of the normal for the same calendar period.", Feature: "climatology", handler: s.handlePercentOfNormal},
+		{Path: "/climatology/cumulative-departure", Methods: []string{"GET"}, Description: "Daily rainfall departures from the monthly normals and their running sum over a date range.", Feature: "climatology", handler: s.handleCumulativeDeparture},
+		{Path: "/climatology/pci", Methods: []string{"GET"}, Description: "Precipitation Concentration Index of a year's monthly rainfall totals, with its class.", Feature: "climatology", handler: s.handlePCI},
+		{Path: "/climatology/erosivity", Methods: []string{"GET"}, Description: "RUSLE rainfall erosivity R-factor estimated from the Modified Fournier Index of the complete years on record.", Feature: "climatology", handler: s.handleErosivity},
+		{Path: "/climatology/year-month-pivot", Methods: []string{"GET"}, Description: "A column as a table of years by months, averaged or summed per month, with an annual value.", Feature: "climatology", handler: s.handleYearMonthPivot},
+		{Path: "/interpolate", Methods: []string{"GET"}, Description: "Inverse-distance-weighted estimate of a column at a point on a date from the k nearest stations.", Feature: "interpolate", handler: s.handleInterpolate},
+		{Path: "/coverage", Methods: []string{"GET"}, Description: "Station-by-month matrix of record counts over a date range.", Feature: "coverage", handler: s.handleCoverage},
+		{Path: "/exports", Methods: []string{"POST"}, Description: "Start a background export of /input/data as CSV or format=tsv, headed by labels or headers=keys, or as CF NetCDF with format=netcdf.", Feature: "export", handler: s.handleCreateExport},
+		{Path: "/exports/", Methods: []string{"GET"}, Description: "Export job status, and the export file at /exports/{id}/download.", Feature: "export", handler: s.handleExport},
+		{Path: "/metrics", Methods: []string{"GET"}, Description: "Aggregate cache counters and cache memory use in the Prometheus text format.", Feature: "metrics", handler: s.handleMetrics},
+		{Path: "/admin/db-stats", Methods: []string{"GET"}, Description: "Database connection pool statistics.", Admin: true, Feature: "admin", handler: s.handleDBStats},
+		{Path: "/admin/refresh-summary", Methods: []string{"POST"}, Description: "Refresh the weather_monthly_summary view behind /aggregate/monthly.", Admin: true, Writes: true, Feature: "admin", handler: s.handleRefreshSummary},
+		{Path: "/admin/dedup", Methods: []string{"POST"}, Description: "Delete duplicate Weather rows of a station over a date range, keeping the lowest id per day.", Admin: true, Writes: true, Feature: "admin", handler: s.handleDedup},
+		{Path: "/weather", Methods: []string{"DELETE"}, Description: "Delete, or with archive=true move to WeatherArchive, a station's observations dated before a day; confirm must repeat the stationNumber.", Admin: true, Writes: true, Feature: "admin", handler: s.handleDeleteWeather},
+		{Path: "/admin/read-only", Methods: []string{"GET", "POST"}, Description: "Show or, with POST ?enabled=true|false, toggle read-only mode.", Admin: true, Feature: "admin", handler: s.handleReadOnly},
+	}
+}
+
+func parseFeatureList(v string) map[string]bool {
+	features := map[string]bool{}
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			features[f] = true
+		}
+	}
+	return features
+}
+
+// checkFeatureList rejects names in a DISABLED_ENDPOINTS value that no route
+// uses, which are most likely typos.
+func checkFeatureList(v string) error {
+	known := map[string]bool{}
+	for _, rt := range (&server{}).routes() {
+		known[rt.Feature] = true
+	}
+	for f := range parseFeatureList(v) {
+		if !known[f] {
+			return errors.New("unknown feature " + strconv.Quote(f))
+		}
+	}
+	return nil
+}
+
+// enabledRoutes is the route registry without the disabled features.
+// Disabled routes are not registered at all, so they answer 404.
+func (s *server) enabledRoutes() []route {
+	enabled := []route{}
+	for _, rt := range s.routes() {
+		if !config.DisabledEndpoints[rt.Feature] {
+			enabled = append(enabled, rt)
+		}
+	}
+	return enabled
+}
+
+// handler builds the mux from the route registry.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	streams := http.NewServeMux()
+	for _, rt := range s.enabledRoutes() {
+		h := rt.handler
+		if rt.Feature == "aggregate" {
+			h = s.cache.wrap(h)
+		}
+		if !rt.Admin && !rt.Writes && !rt.Stream {
+			h = s.withExplain(h)
+		}
+		if rt.Writes {
+			h = s.rejectWritesWhenReadOnly(h)
+		}
+		if rt.Admin {
+			h = requireAdmin(h)
+		} else if rt.Feature != "" {
+			h = checkAPIKey(rt.Feature, h)
+		}
+		if rt.Stream {
+			streams.HandleFunc(rt.Path, cors(rt.Methods, h))
+			continue
+		}
+		mux.HandleFunc(rt.Path, cors(rt.Methods, h))
+	}
+	// Streams take the longer match over the root pattern
+	streams.Handle("/", withDeadline(config.RequestTimeout, limitConcurrency(config.MaxConcurrent, compress(mux))))
+	return logRequests(config.LogFormat, streams)
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	// The root pattern matches every unregistered path as well
+	if r.URL.Path != "/" {
+		httpError(w, r, "Not found.", http.StatusNotFound)
+		return
+	}
+
+	routes := s.enabledRoutes()
+	features := []string{}
+	seen := map[string]bool{}
+	for _, rt := range routes {
+		if rt.Feature != "" && !seen[rt.Feature] {
+			features = append(features, rt.Feature)
+			seen[rt.Feature] = true
+		}
+	}
+
+	writeJSON(w, r, struct {
+		Endpoints []route  `json:"endpoints"`
+		Features  []string `json:"features"`
+	}{
+		Endpoints: routes,
+		Features:  features,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client uploads objects to an S3-compatible store (AWS S3, MinIO, ...)
+// using path-style URLs and Signature Version 4.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+}
+
+// newS3Client configures an S3 client from S3_ENDPOINT, S3_REGION,
+// S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY. It returns nil when no bucket
+// is configured.
+func newS3Client() (*s3Client, error) {
+	bucket := config.S3Bucket
+	if bucket == "" {
+		return nil, nil
+	}
+
+	endpoint := config.S3Endpoint
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid S3_ENDPOINT " + strconv.Quote(endpoint))
+	}
+
+	c := &s3Client{
+		endpoint:  u,
+		region:    config.S3Region,
+		bucket:    bucket,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("S3_BUCKET is set but S3_ACCESS_KEY or S3_SECRET_KEY is missing")
+	}
+	return c, nil
+}
+
+func (c *s3Client) objectPath(key string) string {
+	return strings.TrimSuffix(c.endpoint.Path, "/") + "/" + c.bucket + "/" + key
+}
+
+// Upload stores size bytes from body under key.
+func (c *s3Client) Upload(key string, body io.Reader, size int64, contentType string) error {
+	u := *c.endpoint
+	u.Path = c.objectPath(key)
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 u.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           amzDate,
+	}
+	signedHeaders, signature := c.sign(http.MethodPut, u.Host, u.Path, "", headers, now)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+c.scope(now)+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New("S3 upload failed: " + resp.Status + ": " + string(msg))
+	}
+	return nil
+}
+
+// PresignGet returns a URL granting read access to key for ttl.
+func (c *s3Client) PresignGet(key string, ttl time.Duration) string {
+	u := *c.endpoint
+	u.Path = c.objectPath(key)
+	now := time.Now().UTC()
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	_, signature := c.sign(http.MethodGet, u.Host, u.Path, canonicalQuery(query), map[string]string{"host": u.Host}, now)
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (c *s3Client) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+}
+
+// sign computes the SigV4 signature for a request with an unsigned payload,
+// returning the signed header list alongside it.
+func (c *s3Client) sign(method, host, path, query string, headers map[string]string, now time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		(&url.URL{Path: path}).EscapedPath(),
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + c.scope(now) + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key with RFC 3986
+// escaping, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// weatherColumn describes a queryable Weather column.
+type weatherColumn struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Unit        string `json:"unit"`
+	Description string `json:"description"`
+
+	// Integer marks columns holding whole numbers, such as directions
+	Integer bool `json:"integer,omitempty"`
+
+	// Circular marks directions, which wrap around at 360° and so cannot be
+	// averaged or interpolated as plain numbers
+	Circular bool `json:"circular,omitempty"`
+}
+
+// Label is the human-friendly column title, e.g. "Average Humidity (%)".
+func (c weatherColumn) Label() string {
+	if c.Unit == "" {
+		return c.Name
+	}
+	return c.Name + " (" + c.Unit + ")"
+}
+
+// weatherColumns lists the numeric Weather columns that may be requested by
+// name. Anything else is rejected before it reaches a SQL statement.
+var weatherColumns = []weatherColumn{
+	{Key: "tn", Name: "Minimum Temperature", Unit: "°C", Description: "Daily minimum air temperature."},
+	{Key: "tx", Name: "Maximum Temperature", Unit: "°C", Description: "Daily maximum air temperature."},
+	{Key: "tavg", Name: "Average Temperature", Unit: "°C", Description: "Daily mean air temperature."},
+	{Key: "rh_avg", Name: "Average Humidity", Unit: "%", Description: "Daily mean relative humidity."},
+	{Key: "rr", Name: "Rainfall", Unit: "mm", Description: "Daily accumulated precipitation."},
+	{Key: "ss", Name: "Sunshine Duration", Unit: "hours", Description: "Daily duration of bright sunshine."},
+	{Key: "ff_x", Name: "Maximum Wind Speed", Unit: "m/s", Description: "Daily maximum wind speed."},
+	{Key: "ff_avg", Name: "Average Wind Speed", Unit: "m/s", Description: "Daily mean wind speed."},
+	{Key: "ddd_x", Name: "Direction of Maximum Wind", Unit: "°", Description: "Direction the maximum wind ff_x blew from, in degrees clockwise from north.", Integer: true, Circular: true},
+	{Key: "ddd_car", Name: "Prevailing Wind Direction", Unit: "°", Description: "Most frequent wind direction of the day, in degrees clockwise from north; 0 records calm.", Integer: true, Circular: true},
+}
+
+// dateColumn describes the Tanggal column returned alongside every row.
+var dateColumn = weatherColumn{Key: "Tanggal", Name: "Date", Description: "Observation date, YYYY-MM-DD in station local time."}
+
+// isWeatherColumn reports whether name is a stored numeric column.
+func isWeatherColumn(name string) bool {
+	for _, c := range weatherColumns {
+		if c.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// linearColumn returns an error for a circular column, for the endpoints that
+// average, interpolate or otherwise treat values as points on a line. 350°
+// and 10° would average to 180°; /aggregate/wind computes vector means
+// instead.
+func linearColumn(name string) error {
+	if c, ok := lookupColumn(name); ok && c.Circular {
+		return errors.New(strconv.Quote(name) + " is a wind direction, which cannot be averaged linearly; see /aggregate/wind.")
+	}
+	return nil
+}
+
+// lookupColumn finds a stored or derived column by key.
+func lookupColumn(name string) (weatherColumn, bool) {
+	for _, c := range weatherColumns {
+		if c.Key == name {
+			return c, true
+		}
+	}
+	if f, ok := lookupDerived(name); ok {
+		return f.weatherColumn, true
+	}
+	if name == qcFlagColumn.Key {
+		return qcFlagColumn, true
+	}
+	return weatherColumn{}, false
+}
+
+// columnHeaders returns the CSV header for the given column keys, either the
+// keys themselves or their labels.
+func columnHeaders(keys []string, headers string) ([]string, error) {
+	switch headers {
+	case "keys":
+		return keys, nil
+	case "labels":
+		out := make([]string, len(keys))
+		for i, key := range keys {
+			out[i] = key
+			if key == dateColumn.Key {
+				out[i] = dateColumn.Label()
+			} else if c, ok := lookupColumn(key); ok {
+				out[i] = c.Label()
+			}
+		}
+		return out, nil
+	}
+	return nil, errors.New("headers must be either labels or keys.")
+}
+
+// handleSchema describes the queryable Weather columns and the derived fields
+// computed from them. qc_flag is listed only when the database has it.
+func (s *server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	type columnInfo struct {
+		weatherColumn
+		Label string `json:"label"`
+	}
+	columns := []columnInfo{{dateColumn, dateColumn.Label()}}
+	for _, c := range weatherColumns {
+		columns = append(columns, columnInfo{c, c.Label()})
+	}
+	if s.qcFlag {
+		columns = append(columns, columnInfo{qcFlagColumn, qcFlagColumn.Label()})
+	}
+
+	type derivedInfo struct {
+		derivedField
+		Label string `json:"label"`
+	}
+	derived := []derivedInfo{}
+	for _, f := range derivedFields {
+		derived = append(derived, derivedInfo{f, f.Label()})
+	}
+
+	writeJSON(w, r, struct {
+		Columns []columnInfo  `json:"columns"`
+		Derived []derivedInfo `json:"derived"`
+	}{columns, derived})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// snapshotStation is one station's reading in a snapshot.
+type snapshotStation struct {
+	StationNumber int      `json:"station_number"`
+	StationName   string   `json:"station_name"`
+	Latitude      float64  `json:"latitude"`
+	Longitude     float64  `json:"longitude"`
+	Elevation     *float64 `json:"elevation"`
+	Value         *float64 `json:"value"`
+}
+
+// handleSnapshot returns the value of one column on one date at every
+// station, null where a station has no reading, for drawing maps. With
+// format=geojson the stations are a GeoJSON FeatureCollection of points.
+func (s *server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	day, err := parseDate(values.Get("date"))
+	if err != nil {
+		httpError(w, r, "Invalid request. Invalid date, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	date := day.Format("2006-01-02")
+
+	dataType := values.Get("type")
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+
+	format := values.Get("format")
+	if format != "" && format != "json" && format != "geojson" {
+		httpError(w, r, "Invalid request. format must be either json or geojson.", http.StatusBadRequest)
+		return
+	}
+
+	// Of duplicate rows for a day, the one with the lowest id counts, as
+	// /admin/dedup would keep it
+	rows, err := s.db.QueryContext(r.Context(), "SELECT DISTINCT ON (s.station_number) s.station_number, s.station_name, s.latitude, s.longitude, s.elevation, w.\""+dataType+"\" FROM \"Station\" s LEFT JOIN \"Weather\" w ON w.station_number = s.station_number AND w.\"Tanggal\" = $1 ORDER BY s.station_number, w.id",
+		date)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	stations := []snapshotStation{}
+	for rows.Next() {
+		var st snapshotStation
+		var elevation, value sql.NullFloat64
+		if err := rows.Scan(&st.StationNumber, &st.StationName, &st.Latitude, &st.Longitude, &elevation, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if elevation.Valid {
+			st.Elevation = &elevation.Float64
+		}
+		if value.Valid {
+			st.Value = &value.Float64
+		}
+		stations = append(stations, st)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if format != "geojson" {
+		writeJSON(w, r, struct {
+			Date     string            `json:"date"`
+			Type     string            `json:"type"`
+			Stations []snapshotStation `json:"stations"`
+		}{date, dataType, stations})
+		return
+	}
+
+	type geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+	type feature struct {
+		Type       string          `json:"type"`
+		Geometry   geometry        `json:"geometry"`
+		Properties snapshotStation `json:"properties"`
+	}
+	features := make([]feature, len(stations))
+	for i, st := range stations {
+		// GeoJSON positions are longitude first
+		features[i] = feature{"Feature", geometry{"Point", [2]float64{st.Longitude, st.Latitude}}, st}
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeJSON(w, r, struct {
+		Type     string    `json:"type"`
+		Date     string    `json:"date"`
+		DataType string    `json:"data_type"`
+		Features []feature `json:"features"`
+	}{"FeatureCollection", date, dataType, features})
+}
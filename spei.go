@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// speiMethod documents how the index is computed.
+const speiMethod = "The daily climatic water balance is rr minus the reference evapotranspiration of /aggregate/et0, summed per month and over the scale in months. For each calendar month, a generalized logistic distribution, the three-parameter log-logistic of Vicente-Serrano et al. (2010), is fitted to the sums of all years on record by L-moments from unbiased probability-weighted moments, and the resulting cumulative probability is transformed to the standard normal. Months with fewer than 80% of days having both rr and ET0 count as missing, and a calendar month needs 10 years of sums to be fitted."
+
+// speiPoint is the index for the scale-month period ending in Month.
+type speiPoint struct {
+	Month   string   `json:"month"`
+	Balance *float64 `json:"balance"`
+	SPEI    *float64 `json:"spei"`
+	dataCoverage
+}
+
+// handleSPEI computes the Standardized Precipitation-Evapotranspiration Index
+// series of a station from its full history. windHeight is passed on to the
+// ET0 estimate, as for /aggregate/et0.
+func (s *server) handleSPEI(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	scale := 3
+	if v := values.Get("scale"); v != "" {
+		var err error
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > 48 {
+			httpError(w, r, "Invalid request. scale must be a number of months between 1 and 48.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	windHeight, ok := parseWindHeight(values.Get("windHeight"))
+	if !ok {
+		httpError(w, r, "Invalid request. windHeight must be a height in metres between 0.5 and 100.", http.StatusBadRequest)
+		return
+	}
+
+	station, err := s.lookupStation(r.Context(), stationNumber)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	months, balances, counts, err := s.monthlyWaterBalance(r.Context(), station, windHeight)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Sum every run of scale consecutive months; a gap anywhere in the run
+	// leaves the sum missing
+	sums := make([]float64, len(balances))
+	for i := range balances {
+		sums[i] = math.NaN()
+		if i+1 < scale {
+			continue
+		}
+		sum := 0.0
+		for _, v := range balances[i+1-scale : i+1] {
+			sum += v
+		}
+		sums[i] = sum
+	}
+
+	// Each calendar month gets its own distribution, fitted over every year
+	fits := [12]*logisticFit{}
+	for m := range fits {
+		var sample []float64
+		for i := m; i < len(sums); i += 12 {
+			if !math.IsNaN(sums[i]) {
+				sample = append(sample, sums[i])
+			}
+		}
+		fits[m] = fitLogistic(sample)
+	}
+
+	status := "insufficient_history"
+	series := make([]speiPoint, len(months))
+	for i, month := range months {
+		series[i].Month = month.Format("2006-01")
+		if i+1 >= scale {
+			n := 0
+			for _, c := range counts[i+1-scale : i+1] {
+				n += c
+			}
+			series[i].dataCoverage = newDataCoverage(n, daysBetween(months[i+1-scale], month.AddDate(0, 1, -1)))
+		}
+		if math.IsNaN(sums[i]) {
+			continue
+		}
+		sum := sums[i]
+		series[i].Balance = &sum
+		if fit := fits[i%12]; fit != nil {
+			spei := fit.index(sum)
+			series[i].SPEI = &spei
+			status = "ok"
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string      `json:"station_number"`
+		Scale         int         `json:"scale"`
+		WindHeight    float64     `json:"wind_height"`
+		Status        string      `json:"status"`
+		Method        string      `json:"method"`
+		Series        []speiPoint `json:"series"`
+	}{stationNumber, scale, windHeight, status, speiMethod, series})
+}
+
+// monthlyWaterBalance is monthlyRainfall for the climatic water balance: every
+// month from the station's first to its last day with both rr and an ET0
+// estimate, the monthly totals of rr minus ET0 over those days, and their
+// number. Months without enough such days have a NaN total, and the first
+// month is always a January.
+func (s *server) monthlyWaterBalance(ctx context.Context, station Station, windHeight float64) ([]time.Time, []float64, []int, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT \"Tanggal\", rr, tn, tx, rh_avg, ff_avg, ss FROM \"Weather\" WHERE station_number = $1 AND rr IS NOT NULL AND tn IS NOT NULL AND tx IS NOT NULL ORDER BY \"Tanggal\"",
+		station.StationNumber)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]float64{}
+	dayCounts := map[string]int{}
+	for rows.Next() {
+		var tanggal string
+		var rr float64
+		var tn, tx, rh, wind, ss sql.NullFloat64
+		if err := rows.Scan(&tanggal, &rr, &tn, &tx, &rh, &wind, &ss); err != nil {
+			return nil, nil, nil, err
+		}
+		day, err := time.Parse("2006-01-02", tanggal)
+		if err != nil {
+			continue
+		}
+		et0, _, ok := dailyET0(tn, tx, rh, wind, ss, station, windHeight, day)
+		if !ok {
+			continue
+		}
+		totals[tanggal[:7]] += rr - et0
+		dayCounts[tanggal[:7]]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(dayCounts) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	keys := make([]string, 0, len(dayCounts))
+	for month := range dayCounts {
+		keys = append(keys, month)
+	}
+	sort.Strings(keys)
+	first, err := time.ParseInLocation("2006-01", keys[0], stationTZ)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	last, err := time.ParseInLocation("2006-01", keys[len(keys)-1], stationTZ)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var months []time.Time
+	var values []float64
+	var counts []int
+	for m := time.Date(first.Year(), time.January, 1, 0, 0, 0, 0, stationTZ); !m.After(last); m = m.AddDate(0, 1, 0) {
+		key := m.Format("2006-01")
+		v := math.NaN()
+		if days := m.AddDate(0, 1, -1).Day(); float64(dayCounts[key]) >= monthMinCoverage*float64(days) {
+			v = totals[key]
+		}
+		months = append(months, m)
+		values = append(values, v)
+		counts = append(counts, dayCounts[key])
+	}
+	return months, values, counts, nil
+}
+
+// logisticFit is a generalized logistic distribution of water balance sums,
+// which unlike rainfall may be negative, in Hosking's parametrization with
+// location xi, scale alpha and shape k; k = 0 is the logistic distribution.
+type logisticFit struct {
+	xi, alpha, k float64
+}
+
+// fitLogistic fits the sample by its L-moments, computed from unbiased
+// probability-weighted moments, returning nil when it is too short or too
+// uniform to fit.
+func fitLogistic(sample []float64) *logisticFit {
+	if len(sample) < spiMinYears {
+		return nil
+	}
+	sorted := append([]float64(nil), sample...)
+	sort.Float64s(sorted)
+
+	n := float64(len(sorted))
+	var b0, b1, b2 float64
+	for i, x := range sorted {
+		j := float64(i)
+		b0 += x
+		b1 += j / (n - 1) * x
+		b2 += j * (j - 1) / ((n - 1) * (n - 2)) * x
+	}
+	b0, b1, b2 = b0/n, b1/n, b2/n
+	l1, l2, l3 := b0, 2*b1-b0, 6*b2-6*b1+b0
+	if !(l2 > 0) {
+		return nil
+	}
+
+	k := -l3 / l2
+	if math.Abs(k) < 1e-6 {
+		return &logisticFit{xi: l1, alpha: l2}
+	}
+	alpha := l2 * math.Sin(k*math.Pi) / (k * math.Pi)
+	return &logisticFit{xi: l1 - alpha*(1/k-math.Pi/math.Sin(k*math.Pi)), alpha: alpha, k: k}
+}
+
+// index transforms a water balance sum to the standard normal.
+func (l *logisticFit) index(x float64) float64 {
+	y := (x - l.xi) / l.alpha
+	if l.k != 0 {
+		// Beyond the bound of a skewed distribution the probability is 0 or 1
+		arg := 1 - l.k*y
+		if arg <= 0 {
+			if l.k > 0 {
+				return spiLimit
+			}
+			return -spiLimit
+		}
+		y = -math.Log(arg) / l.k
+	}
+	p := 1 / (1 + math.Exp(-y))
+	spei := math.Sqrt2 * math.Erfinv(2*p-1)
+	return math.Max(-spiLimit, math.Min(spiLimit, spei))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// spiMinYears is the number of rainfall totals a calendar month needs before
+// a distribution is fitted to it.
+const spiMinYears = 10
+
+// spiLimit bounds the index, as the tails of a fitted distribution are not
+// meaningful beyond roughly ±3.
+const spiLimit = 3.09
+
+// spiMethod documents how the index is computed.
+const spiMethod = "Monthly rr totals are summed over the scale in months. For each calendar month, a gamma distribution is fitted to the non-zero sums of all years on record (Thom's maximum likelihood estimate), mixed with the probability of a zero sum, and the resulting cumulative probability is transformed to the standard normal. Months with fewer than 80% of days recorded count as missing."
+
+// spiPoint is the index for the scale-month period ending in Month.
+type spiPoint struct {
+	Month         string   `json:"month"`
+	Precipitation *float64 `json:"precipitation"`
+	SPI           *float64 `json:"spi"`
+	dataCoverage
+}
+
+// handleSPI computes the Standardized Precipitation Index series of a station
+// from its full rainfall history.
+func (s *server) handleSPI(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	scale := 3
+	if v := values.Get("scale"); v != "" {
+		var err error
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > 48 {
+			httpError(w, r, "Invalid request. scale must be a number of months between 1 and 48.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	months, totals, counts, err := s.monthlyRainfall(r.Context(), stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Sum every run of scale consecutive months; a gap anywhere in the run
+	// leaves the sum missing
+	sums := make([]float64, len(totals))
+	for i := range totals {
+		sums[i] = math.NaN()
+		if i+1 < scale {
+			continue
+		}
+		sum := 0.0
+		for _, v := range totals[i+1-scale : i+1] {
+			sum += v
+		}
+		sums[i] = sum
+	}
+
+	// Each calendar month gets its own distribution, fitted over every year
+	fits := [12]*gammaFit{}
+	for m := range fits {
+		var sample []float64
+		for i := m; i < len(sums); i += 12 {
+			if !math.IsNaN(sums[i]) {
+				sample = append(sample, sums[i])
+			}
+		}
+		fits[m] = fitGamma(sample)
+	}
+
+	status := "insufficient_history"
+	series := make([]spiPoint, len(months))
+	for i, month := range months {
+		series[i].Month = month.Format("2006-01")
+		if i+1 >= scale {
+			n := 0
+			for _, c := range counts[i+1-scale : i+1] {
+				n += c
+			}
+			series[i].dataCoverage = newDataCoverage(n, daysBetween(months[i+1-scale], month.AddDate(0, 1, -1)))
+		}
+		if math.IsNaN(sums[i]) {
+			continue
+		}
+		sum := sums[i]
+		series[i].Precipitation = &sum
+		if fit := fits[i%12]; fit != nil {
+			spi := fit.index(sum)
+			series[i].SPI = &spi
+			status = "ok"
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string     `json:"station_number"`
+		Scale         int        `json:"scale"`
+		Status        string     `json:"status"`
+		Method        string     `json:"method"`
+		Series        []spiPoint `json:"series"`
+	}{stationNumber, scale, status, spiMethod, series})
+}
+
+// monthlyRainfall returns every month from the station's first to its last
+// rr reading, together with the monthly totals and the number of days with a
+// reading. Months without enough readings have a NaN total. The first month
+// is always a January, so that index i falls in calendar month i%12.
+func (s *server) monthlyRainfall(ctx context.Context, stationNumber string) ([]time.Time, []float64, []int, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT SUBSTRING(\"Tanggal\", 1, 7), SUM(rr), COUNT(rr) FROM \"Weather\" WHERE station_number = $1 AND rr IS NOT NULL GROUP BY 1 ORDER BY 1",
+		stationNumber)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]float64{}
+	dayCounts := map[string]int{}
+	var first, last time.Time
+	for rows.Next() {
+		var month string
+		var sum float64
+		var count int
+		if err := rows.Scan(&month, &sum, &count); err != nil {
+			return nil, nil, nil, err
+		}
+		start, err := time.ParseInLocation("2006-01", month, stationTZ)
+		if err != nil {
+			continue
+		}
+		dayCounts[month] = count
+		days := start.AddDate(0, 1, -1).Day()
+		if float64(count) >= monthMinCoverage*float64(days) {
+			totals[month] = sum
+		}
+		if first.IsZero() {
+			first = start
+		}
+		last = start
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	if first.IsZero() {
+		return nil, nil, nil, nil
+	}
+
+	var months []time.Time
+	var values []float64
+	var counts []int
+	for m := time.Date(first.Year(), time.January, 1, 0, 0, 0, 0, stationTZ); !m.After(last); m = m.AddDate(0, 1, 0) {
+		v, ok := totals[m.Format("2006-01")]
+		if !ok {
+			v = math.NaN()
+		}
+		months = append(months, m)
+		values = append(values, v)
+		counts = append(counts, dayCounts[m.Format("2006-01")])
+	}
+	return months, values, counts, nil
+}
+
+// gammaFit is a gamma distribution of rainfall sums, mixed with the
+// probability of a sum of zero.
+type gammaFit struct {
+	shape, scale float64
+	zeroProb     float64
+}
+
+// fitGamma fits the sample with Thom's estimator, returning nil when it is
+// too short or too uniform to fit.
+func fitGamma(sample []float64) *gammaFit {
+	if len(sample) < spiMinYears {
+		return nil
+	}
+	var zeros int
+	var sum, logSum float64
+	for _, v := range sample {
+		if v <= 0 {
+			zeros++
+			continue
+		}
+		sum += v
+		logSum += math.Log(v)
+	}
+	n := float64(len(sample) - zeros)
+	if n < 2 {
+		return nil
+	}
+	mean := sum / n
+	a := math.Log(mean) - logSum/n
+	if a <= 0 {
+		return nil
+	}
+	shape := (1 + math.Sqrt(1+4*a/3)) / (4 * a)
+	return &gammaFit{shape: shape, scale: mean / shape, zeroProb: float64(zeros) / float64(len(sample))}
+}
+
+// index transforms a rainfall sum to the standard normal.
+func (g *gammaFit) index(x float64) float64 {
+	p := g.zeroProb
+	if x > 0 {
+		p += (1 - g.zeroProb) * lowerGammaP(g.shape, x/g.scale)
+	}
+	spi := math.Sqrt2 * math.Erfinv(2*p-1)
+	return math.Max(-spiLimit, math.Min(spiLimit, spi))
+}
+
+// lowerGammaP is the regularized lower incomplete gamma function P(a, x),
+// evaluated by its series below a+1 and its continued fraction above.
+func lowerGammaP(a, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	lg, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lg)
+
+	if x < a+1 {
+		term, sum := 1/a, 1/a
+		for n := 1; n < 500; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-14 {
+				break
+			}
+		}
+		return sum * prefix
+	}
+
+	// Lentz's method for the continued fraction of Q(a, x)
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < 500; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-14 {
+			break
+		}
+	}
+	return 1 - prefix*h
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// referenceStats are the long-term mean and sample standard deviation a
+// value is standardized against. Month is the calendar month, 1 to 12, of
+// deseasonalized statistics and 0 for a single set.
+type referenceStats struct {
+	Month  int      `json:"month,omitempty"`
+	Mean   *float64 `json:"mean"`
+	StdDev *float64 `json:"std_dev"`
+	N      int      `json:"n"`
+}
+
+// handleStandardized returns a column's values over a date range as z-scores
+// against the station's full history: (value - mean) / standard deviation.
+// With deseasonalize=true each value is standardized against the statistics
+// of its calendar month, which removes the seasonal cycle. NULL values, and
+// values whose reference has fewer than two readings or no spread, have a
+// null z-score.
+func (s *server) handleStandardized(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deseasonalize := false
+	switch values.Get("deseasonalize") {
+	case "", "false":
+	case "true":
+		deseasonalize = true
+	default:
+		httpError(w, r, "Invalid request. deseasonalize must be either true or false.", http.StatusBadRequest)
+		return
+	}
+
+	// Without deseasonalizing, every day falls into the same group 0
+	group := "0"
+	if deseasonalize {
+		group = "CAST(SUBSTRING(\"Tanggal\", 6, 2) AS integer)"
+	}
+	rows, err := s.db.QueryContext(r.Context(), "SELECT "+group+", AVG(\""+dataType+"\"), STDDEV_SAMP(\""+dataType+"\"), COUNT(\""+dataType+"\") FROM \"Weather\" WHERE station_number = $1 GROUP BY 1 ORDER BY 1",
+		stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	reference := map[int]*referenceStats{}
+	for rows.Next() {
+		var month, n int
+		var mean, stddev sql.NullFloat64
+		if err := rows.Scan(&month, &mean, &stddev, &n); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		stats := &referenceStats{Month: month, N: n}
+		if mean.Valid {
+			stats.Mean = &mean.Float64
+		}
+		if stddev.Valid {
+			stats.StdDev = &stddev.Float64
+		}
+		reference[month] = stats
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	rows, err = s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", \""+dataType+"\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 ORDER BY \"Tanggal\"",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type standardizedDay struct {
+		Date  string   `json:"date"`
+		Value *float64 `json:"value"`
+		Z     *float64 `json:"z"`
+	}
+	series := []standardizedDay{}
+	for rows.Next() {
+		var d standardizedDay
+		var value sql.NullFloat64
+		if err := rows.Scan(&d.Date, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if value.Valid {
+			d.Value = &value.Float64
+			month := 0
+			if deseasonalize && len(d.Date) >= 7 {
+				month, _ = strconv.Atoi(d.Date[5:7])
+			}
+			if stats := reference[month]; stats != nil && stats.Mean != nil && stats.StdDev != nil && *stats.StdDev > 0 {
+				z := (value.Float64 - *stats.Mean) / *stats.StdDev
+				d.Z = &z
+			}
+		}
+		series = append(series, d)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	statistics := []*referenceStats{}
+	for month := 0; month <= 12; month++ {
+		if stats := reference[month]; stats != nil {
+			statistics = append(statistics, stats)
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string            `json:"station_number"`
+		Type          string            `json:"type"`
+		Deseasonalize bool              `json:"deseasonalize"`
+		Reference     []*referenceStats `json:"reference"`
+		Series        []standardizedDay `json:"series"`
+	}{stationNumber, dataType, deseasonalize, statistics, series})
+}
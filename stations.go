@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// stationFilter builds the SQL condition for the include and exclude
+// parameters, comma-separated station numbers to restrict a listing to or to
+// leave out of it. column is the station_number column to filter on and
+// args the query's arguments so far; the numbers are appended to them as
+// placeholders. Without either parameter the condition is "TRUE".
+func stationFilter(values url.Values, column string, args []interface{}) (string, []interface{}, error) {
+	var conditions []string
+	for _, param := range []string{"include", "exclude"} {
+		v := values.Get(param)
+		if v == "" {
+			continue
+		}
+		var placeholders []string
+		for _, n := range strings.Split(v, ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(n))
+			if err != nil {
+				return "", nil, errors.New(param + " must be a comma-separated list of station numbers.")
+			}
+			args = append(args, number)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+		op := " IN ("
+		if param == "exclude" {
+			op = " NOT IN ("
+		}
+		conditions = append(conditions, column+op+strings.Join(placeholders, ", ")+")")
+	}
+	if len(conditions) == 0 {
+		return "TRUE", args, nil
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// handleStations lists the weather stations by number, optionally narrowed
+// down with include or exclude and paginated with limit and offset.
+func (s *server) handleStations(w http.ResponseWriter, r *http.Request) {
+	filter, args, err := stationFilter(r.URL.Query(), "station_number", nil)
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := parsePage(r.URL.Query())
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM \"Station\" WHERE "+filter, args...).Scan(&total); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Execute the query
+	rows, err := s.db.QueryContext(r.Context(), "SELECT * FROM \"Station\" WHERE "+filter+" ORDER BY station_number"+p.sql(), args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Iterate over the rows and store them in a slice
+	stations := []Station{}
+	for rows.Next() {
+		var station Station
+		err := rows.Scan(&station.StationNumber, &station.StationName, &station.Latitude, &station.Longitude, &station.Elevation)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		stations = append(stations, station)
+	}
+
+	// Check for any errors during iteration
+	err = rows.Err()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Convert the slice to JSON and write the response
+	writePage(w, r, p, total, stations)
+}
+
+// lookupStation loads one station, returning sql.ErrNoRows when it does not
+// exist.
+func (s *server) lookupStation(ctx context.Context, stationNumber string) (Station, error) {
+	var station Station
+	err := s.db.QueryRowContext(ctx, "SELECT station_number, station_name, latitude, longitude, elevation FROM \"Station\" WHERE station_number = $1", stationNumber).
+		Scan(&station.StationNumber, &station.StationName, &station.Latitude, &station.Longitude, &station.Elevation)
+	return station, err
+}
+
+// maxStationPatch bounds the size of a PATCH /stations/{id} body.
+const maxStationPatch = 1 << 16
+
+// handlePatchStation updates the fields given in a JSON body, any subset of
+// station_name, latitude, longitude and elevation, of the station at
+// /stations/{id}, leaving the others alone. An explicit "elevation": null
+// clears the elevation, while omitting it keeps the current one. The station
+// number itself cannot change. Responds with the updated station.
+func (s *server) handlePatchStation(w http.ResponseWriter, r *http.Request) {
+	stationNumber, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/stations/"))
+	if err != nil {
+		httpError(w, r, "Not found.", http.StatusNotFound)
+		return
+	}
+
+	// Decoding into raw messages tells a null apart from an absent field
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxStationPatch)).Decode(&fields); err != nil {
+		httpError(w, r, "Invalid request. The body must be a JSON object.", http.StatusBadRequest)
+		return
+	}
+	if len(fields) == 0 {
+		httpError(w, r, "Invalid request. The body must set at least one field.", http.StatusBadRequest)
+		return
+	}
+
+	var assignments []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		assignments = append(assignments, column+" = $"+strconv.Itoa(len(args)))
+	}
+	for _, column := range []string{"station_name", "latitude", "longitude", "elevation"} {
+		raw, ok := fields[column]
+		if !ok {
+			continue
+		}
+		delete(fields, column)
+
+		if column == "station_name" {
+			var name string
+			if err := json.Unmarshal(raw, &name); err != nil || strings.TrimSpace(name) == "" {
+				httpError(w, r, "Invalid request. station_name must be a non-empty string.", http.StatusBadRequest)
+				return
+			}
+			set(column, name)
+			continue
+		}
+
+		var value *float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			httpError(w, r, "Invalid request. "+column+" must be a number.", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case value == nil && column != "elevation":
+			httpError(w, r, "Invalid request. "+column+" cannot be null.", http.StatusBadRequest)
+			return
+		case value == nil:
+			set(column, nil)
+		case column == "latitude" && math.Abs(*value) > 90:
+			httpError(w, r, "Invalid request. latitude must be between -90 and 90.", http.StatusBadRequest)
+			return
+		case column == "longitude" && math.Abs(*value) > 180:
+			httpError(w, r, "Invalid request. longitude must be between -180 and 180.", http.StatusBadRequest)
+			return
+		default:
+			set(column, *value)
+		}
+	}
+	for field := range fields {
+		httpError(w, r, "Invalid request. Unknown or read-only field "+strconv.Quote(field)+".", http.StatusBadRequest)
+		return
+	}
+
+	args = append(args, stationNumber)
+	var station Station
+	err = s.db.QueryRowContext(r.Context(), "UPDATE \"Station\" SET "+strings.Join(assignments, ", ")+" WHERE station_number = $"+strconv.Itoa(len(args))+" RETURNING station_number, station_name, latitude, longitude, elevation", args...).
+		Scan(&station.StationNumber, &station.StationName, &station.Latitude, &station.Longitude, &station.Elevation)
+	if err == sql.ErrNoRows {
+		httpError(w, r, "Station not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// Aggregates such as sunshine and et0 depend on the coordinates
+	s.cache.invalidateStation(strconv.Itoa(stationNumber))
+
+	writeJSON(w, r, station)
+}
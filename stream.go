@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamHeartbeat is how often an idle event stream sends a comment, so that
+// proxies do not take it for a dead connection.
+const streamHeartbeat = 15 * time.Second
+
+// handleStream pushes a station's observations as server-sent events: first
+// the newest one as a snapshot, then every newer row as it arrives, found by
+// polling every STREAM_POLL_SECONDS. Each event is an observation event with
+// the row as JSON and its Tanggal as the id, so a reconnecting client sending
+// Last-Event-ID resumes after it without a new snapshot. type restricts the
+// columns, as for /input/data; by default all stored ones are sent.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	var types []string
+	if v := values.Get("type"); v != "" {
+		types = strings.Split(v, ",")
+	} else {
+		for _, c := range weatherColumns {
+			types = append(types, c.Key)
+		}
+	}
+	columns, derived, hidden, err := resolveTypes(types)
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	quoted := make([]string, len(columns))
+	for i := range columns {
+		quoted[i] = `"` + columns[i] + `"`
+	}
+	selectList := strings.Join(quoted, ",")
+	order := s.outputColumns(types, true)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		serverError(w, r, errors.New("response writer cannot flush"))
+		return
+	}
+
+	// The raw Tanggal of the last event sent, which later polls continue
+	// after; it may be sub-daily, "2023-01-01 13:00", so it is compared as
+	// it is rather than as a date. Without one, the first poll starts at the
+	// newest row, which makes it the snapshot, and with no rows at all every
+	// row is new
+	last := r.Header.Get("Last-Event-ID")
+	if len(last) < 10 {
+		last = ""
+	} else if _, err := time.Parse("2006-01-02", last[:10]); err != nil {
+		last = ""
+	}
+	op := ">"
+	if last == "" {
+		var newest sql.NullString
+		err := s.db.QueryRowContext(r.Context(), "SELECT MAX(\"Tanggal\") FROM \"Weather\" WHERE station_number = $1",
+			stationNumber).Scan(&newest)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if newest.Valid {
+			last, op = newest.String, ">="
+		}
+	}
+
+	// The flag's column type varies between databases, so it is read as a
+	// plain number, as eachWeatherRow does
+	if s.qcFlag {
+		selectList += ",CAST(qc_flag AS double precision) AS qc_flag"
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx would otherwise hold the events back in its buffer
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(row map[string]interface{}) error {
+		applyDerivedRow(row, derived, hidden)
+		data, err := json.Marshal(orderedRow{order, row})
+		if err != nil {
+			return err
+		}
+		tanggal, _ := row[dateColumn.Key].(string)
+		if _, err := fmt.Fprintf(w, "event: observation\nid: %s\ndata: %s\n\n", tanggal, data); err != nil {
+			return err
+		}
+		if tanggal > last {
+			last = tanggal
+		}
+		return nil
+	}
+	poll := func() error {
+		rows, err := s.db.QueryContext(r.Context(), "SELECT "+selectList+",\"Tanggal\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" "+op+" $2 ORDER BY \"Tanggal\"",
+			stationNumber, last)
+		if err != nil {
+			return err
+		}
+		op = ">"
+		if err := scanWeatherRows(rows, nil, send); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	polls := time.NewTicker(config.StreamPoll)
+	defer polls.Stop()
+	heartbeats := time.NewTicker(streamHeartbeat)
+	defer heartbeats.Stop()
+	err = poll()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			// The client went away
+			return
+		case <-heartbeats.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err == nil {
+				flusher.Flush()
+			}
+		case <-polls.C:
+			err = poll()
+		}
+	}
+	if r.Context().Err() == nil {
+		// The status line has gone out already, so all that is left is to
+		// log and end the stream with an error event
+		log.Println(err)
+		fmt.Fprint(w, "event: error\ndata: \"Internal server error.\"\n\n")
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// tropicalPeriod is the tropical nights of one month or year.
+type tropicalPeriod struct {
+	Period   string   `json:"period"`
+	Count    int      `json:"count"`
+	Dates    []string `json:"dates"`
+	Excluded int      `json:"excluded"`
+	dataCoverage
+}
+
+// handleTropicalNights counts the ETCCDI tropical nights of a station within
+// a date range, the days with tn above threshold, 20 °C by default. Days
+// without a tn reading cannot be counted either way and are reported as
+// excluded. With interval=month or interval=year the counts are also broken
+// down per period.
+func (s *server) handleTropicalNights(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	threshold := 20.0
+	if v := values.Get("threshold"); v != "" {
+		threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			httpError(w, r, "Invalid request. threshold must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	interval := values.Get("interval")
+	if interval != "" && interval != "month" && interval != "year" {
+		httpError(w, r, "Invalid request. interval must be either month or year.", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", tn > $4 FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 AND tn IS NOT NULL ORDER BY \"Tanggal\"",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), threshold)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	dates := []string{}
+	observed := 0
+	var periods []*tropicalPeriod
+	for rows.Next() {
+		var tanggal string
+		var tropical bool
+		if err := rows.Scan(&tanggal, &tropical); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		observed++
+		if tropical {
+			dates = append(dates, tanggal)
+		}
+
+		if interval != "" {
+			key := intervalKey(tanggal, interval)
+			if len(periods) == 0 || periods[len(periods)-1].Period != key {
+				periods = append(periods, &tropicalPeriod{Period: key, Dates: []string{}})
+			}
+			current := periods[len(periods)-1]
+			current.N++
+			if tropical {
+				current.Count++
+				current.Dates = append(current.Dates, tanggal)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, p := range periods {
+		days := periodDays(p.Period, interval, startDate, endDate)
+		p.dataCoverage = newDataCoverage(p.N, days)
+		p.Excluded = days - p.N
+	}
+
+	days := daysBetween(startDate, endDate)
+	writeJSON(w, r, struct {
+		StationNumber string            `json:"station_number"`
+		Threshold     float64           `json:"threshold"`
+		Count         int               `json:"count"`
+		Dates         []string          `json:"dates"`
+		Excluded      int               `json:"excluded"`
+		Periods       []*tropicalPeriod `json:"periods,omitempty"`
+		dataCoverage
+	}{stationNumber, threshold, len(dates), dates, days - observed, periods, newDataCoverage(observed, days)})
+}
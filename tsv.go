@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// tsvEscaper escapes the characters a tab-separated value cannot contain,
+// with backslash escapes as in the linear TSV convention.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// tsvStream writes weather rows as tab-separated values, which paste into
+// spreadsheets without the quoting CSV needs. Like csvStream it pushes the
+// output to the client every CSV_FLUSH_ROWS rows.
+type tsvStream struct {
+	bw      *bufio.Writer
+	flusher http.Flusher
+	columns []string
+	rows    int
+}
+
+func newTSVStream(w io.Writer, columns []string) *tsvStream {
+	flusher, _ := w.(http.Flusher)
+	return &tsvStream{bw: bufio.NewWriter(w), flusher: flusher, columns: columns}
+}
+
+// WriteHeader writes the header line and sends it straight away.
+func (t *tsvStream) WriteHeader(header []string) error {
+	t.writeRecord(header)
+	return t.Flush()
+}
+
+func (t *tsvStream) WriteRow(row map[string]interface{}) error {
+	record := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		record[i] = formatValue(row[col])
+	}
+	t.writeRecord(record)
+	t.rows++
+	if config.CSVFlushRows > 0 && t.rows%config.CSVFlushRows == 0 {
+		return t.Flush()
+	}
+	return nil
+}
+
+func (t *tsvStream) writeRecord(fields []string) {
+	for i, field := range fields {
+		if i > 0 {
+			t.bw.WriteByte('\t')
+		}
+		tsvEscaper.WriteString(t.bw, field)
+	}
+	t.bw.WriteByte('\n')
+}
+
+// Close flushes the remaining rows.
+func (t *tsvStream) Close() error {
+	return t.Flush()
+}
+
+func (t *tsvStream) Flush() error {
+	if err := t.bw.Flush(); err != nil {
+		return err
+	}
+	if t.flusher != nil {
+		t.flusher.Flush()
+	}
+	return nil
+}
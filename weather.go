@@ -0,0 +1,1169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateFormats describes the formats parseDate accepts, for error messages.
+const dateFormats = "YYYY-MM-DD, YYYY/MM/DD, DD-MM-YYYY or RFC 3339"
+
+// parseDate parses a date given in any of dateFormats as a calendar day in
+// stationTZ. An RFC 3339 timestamp stands for the station day it falls on,
+// whatever its zone. Every endpoint taking a date parses it here, so they
+// all accept the same formats.
+func parseDate(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	for _, layout := range []string{"2006-01-02", "2006/01/02", "02-01-2006"} {
+		if day, err := time.ParseInLocation(layout, v, stationTZ); err == nil {
+			return day, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		t = t.In(stationTZ)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, stationTZ), nil
+	}
+	return time.Time{}, errors.New("expected " + dateFormats + ".")
+}
+
+// parseDateRange splits a "start,end" date range into its two dates. Both
+// parts must be present and formatted as one of dateFormats.
+//
+// The dates are interpreted as calendar days in stationTZ, the same days the
+// Tanggal column records, and both bounds are inclusive: 2023-01-01,2023-01-31
+// covers midnight on the 1st through the end of the 31st station local time,
+// regardless of the zone the server itself runs in.
+func parseDateRange(dateRange string) (time.Time, time.Time, error) {
+	parts := strings.Split(dateRange, ",")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, errors.New("dateRange must be two dates separated by a comma, e.g. 2023-01-01,2023-01-31.")
+	}
+
+	startDate, err := parseDate(parts[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid start date in dateRange, " + err.Error())
+	}
+
+	endDate, err := parseDate(parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid end date in dateRange, " + err.Error())
+	}
+
+	return startDate, endDate, nil
+}
+
+// setCacheControl marks a response cacheable when the requested range lies
+// entirely before today, since past observations no longer change. Ranges that
+// include today may still receive new data and must be revalidated.
+func setCacheControl(w http.ResponseWriter, endDate time.Time) {
+	now := time.Now().In(stationTZ)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, stationTZ)
+	if endDate.Before(today) {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(config.CacheMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
+
+// notModified sets Last-Modified from the newest observation date in the
+// response and answers 304 when the client's If-Modified-Since already covers
+// it. Observations only ever get appended, so the newest Tanggal stands in for
+// the data's modification time.
+func notModified(w http.ResponseWriter, r *http.Request, newest string) bool {
+	if newest == "" {
+		return false
+	}
+	day, err := time.ParseInLocation("2006-01-02", newest, stationTZ)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Last-Modified", day.UTC().Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || day.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// parseDateRanges parses every requested range. Ranges may be given as
+// repeated dateRange parameters, a semicolon-delimited list, or both.
+func parseDateRanges(params []string) ([]dateRange, error) {
+	var ranges []dateRange
+	for _, param := range params {
+		for _, raw := range strings.Split(param, ";") {
+			start, end, err := parseDateRange(raw)
+			if err != nil {
+				return nil, errors.New("dateRange " + strconv.Quote(raw) + ": " + err.Error())
+			}
+			ranges = append(ranges, dateRange{Start: start, End: end})
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("Missing dateRange.")
+	}
+	if len(ranges) > config.MaxDateRanges {
+		return nil, errors.New("At most " + strconv.Itoa(config.MaxDateRanges) + " date ranges may be requested at once.")
+	}
+	return ranges, nil
+}
+
+// dateRange is an inclusive range of station calendar days.
+type dateRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// handleInputData returns the requested columns of a station's observations
+// over one or more date ranges. With sparse=true, NULL columns are omitted
+// from each row rather than returned as null. format=csv returns the rows as
+// CSV, headed by column keys or, with headers=labels, their labels,
+// format=tsv likewise as tab-separated values, format=parquet as a Parquet
+// file for analytics tooling, and format=influx as InfluxDB line protocol for
+// time-series databases. layout=series returns the JSON as one series per
+// type with its unit instead, and baseline=mean|median|<number> returns
+// departures from a baseline. Rows include qc_flag where the database has
+// it, and minQuality filters on it. Columns come in the requested order, led
+// by Tanggal or, with dateFirst=false, followed by it. resolution=N
+// downsamples the JSON to about N points, by largest-triangle-three-buckets
+// per series with layout=series or by averaging runs of rows,
+// downsample=mean, otherwise. Rows that fail to scan are skipped rather than
+// failing the request; the JSON then reports them under skipped_rows. With
+// strict=false unknown types are dropped with a warning instead of failing
+// the request.
+func (s *server) handleInputData(w http.ResponseWriter, r *http.Request) {
+	// Get the query parameters from the URL
+	values := r.URL.Query()
+	q, errs := s.parseDataQuery(values)
+	if len(errs) > 0 {
+		httpError(w, r, "Invalid request. "+errs[0], http.StatusBadRequest)
+		return
+	}
+
+	// The response is only cached when every range lies in the past
+	latest := q.ranges[0].End
+	for _, dr := range q.ranges {
+		if dr.End.After(latest) {
+			latest = dr.End
+		}
+	}
+	setCacheControl(w, latest)
+
+	// CSV, TSV, Parquet and line protocol are streamed row by row as they are
+	// read, so Last-Modified comes from a separate lookup of the newest
+	// observation
+	if q.format == "csv" || q.format == "tsv" || q.format == "parquet" || q.format == "influx" {
+		newest, err := s.newestObservation(r.Context(), q.stationNumber, q.ranges)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if notModified(w, r, newest) {
+			return
+		}
+		// The body has no room for warnings, so they go in the headers
+		for _, warning := range q.warnings {
+			w.Header().Add("Warning", "199 - "+strconv.Quote(warning))
+		}
+
+		var skipped skippedRows
+		var stream rowStream
+		switch q.format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			csvStream := newCSVStream(w, q.columns)
+			err = csvStream.WriteHeader(q.header)
+			stream = csvStream
+		case "tsv":
+			w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+			tsvStream := newTSVStream(w, q.columns)
+			err = tsvStream.WriteHeader(q.header)
+			stream = tsvStream
+		case "parquet":
+			// A single file covers every range
+			w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+			w.Header().Set("Content-Disposition", `attachment; filename="station-`+q.stationNumber+`.parquet"`)
+			stream, err = newParquetStream(w, append(q.types, s.qualityColumns()...))
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+		case "influx":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			stream = newInfluxStream(w, q.stationNumber, append(q.types, s.qualityColumns()...))
+		}
+		for _, dr := range q.ranges {
+			if err != nil {
+				break
+			}
+			err = s.eachWeatherRow(r.Context(), q.selectList, q.stationNumber, dr, q.minQuality, &skipped, func(row map[string]interface{}) error {
+				applyDerivedRow(row, q.derived, q.hidden)
+				return stream.WriteRow(row)
+			})
+		}
+		if err == nil {
+			err = stream.Close()
+		}
+		if err != nil {
+			// The status line has already gone out, so all that is left is to
+			// log and cut the download short
+			log.Println(err)
+		}
+		if skipped.Count > 0 {
+			log.Printf("station %s: skipped %d rows that failed to scan, e.g. %s", q.stationNumber, skipped.Count, skipped.Samples[0])
+		}
+		return
+	}
+
+	// Query each range separately
+	type rangeResult struct {
+		StartDate string       `json:"start_date"`
+		EndDate   string       `json:"end_date"`
+		Rows      []orderedRow `json:"data"`
+
+		// Data holds the rows as they are worked on, Rows them in column order
+		Data []map[string]interface{} `json:"-"`
+	}
+	grouped := make([]rangeResult, 0, len(q.ranges))
+	newest := ""
+	var skipped skippedRows
+	for _, dr := range q.ranges {
+		results, err := s.queryWeather(r.Context(), q.selectList, q.stationNumber, dr, q.minQuality, &skipped, config.MaxResponseBytes)
+		if err == errResponseTooLarge {
+			responseTooLarge(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		for _, row := range results {
+			if tanggal, ok := row[dateColumn.Key].(string); ok && tanggal > newest {
+				newest = tanggal
+			}
+		}
+		applyDerived(results, q.derived, q.hidden)
+		grouped = append(grouped, rangeResult{
+			StartDate: dr.Start.Format("2006-01-02"),
+			EndDate:   dr.End.Format("2006-01-02"),
+			Data:      results,
+		})
+	}
+
+	// Polling clients can skip the body when no newer observation arrived
+	if notModified(w, r, newest) {
+		return
+	}
+
+	// The baseline is computed over every returned row, before sparse mode
+	// drops the missing values
+	var baselines map[string]*float64
+	if q.baseline != "" {
+		var rows []map[string]interface{}
+		for _, g := range grouped {
+			rows = append(rows, g.Data...)
+		}
+		baselines = applyBaseline(rows, q.types, q.baseline)
+	}
+	if q.resolution > 0 && q.downsample == "mean" {
+		for i, g := range grouped {
+			grouped[i].Data = meanBuckets(g.Data, q.types, q.resolution)
+		}
+	}
+	if q.sparse {
+		for _, g := range grouped {
+			dropNulls(g.Data)
+		}
+	}
+	for i, g := range grouped {
+		grouped[i].Rows = orderRows(g.Data, q.columns)
+	}
+
+	// Convert the results to JSON. A single range keeps the original bare
+	// array; several ranges are returned grouped by range.
+	var data interface{} = grouped
+	if len(grouped) == 1 {
+		data = grouped[0].Rows
+	}
+	if q.layout == "series" {
+		var rows []map[string]interface{}
+		for _, g := range grouped {
+			rows = append(rows, g.Data...)
+		}
+		series := seriesByType(q.types, rows, q.sparse)
+		if q.resolution > 0 && q.downsample == "lttb" {
+			for i, ts := range series {
+				if isCategorical(ts.Type) {
+					series[i].Data = strideSample(ts.Data, q.resolution)
+				} else {
+					series[i].Data = lttb(ts.Data, q.resolution)
+				}
+			}
+		}
+		data = struct {
+			Series []typeSeries `json:"series"`
+		}{series}
+	}
+
+	// With includeStation=true the data is wrapped together with the station
+	// it belongs to, saving charting clients a call to /stations. A baseline
+	// likewise wraps the data, so the chart can be labelled with it, and so do
+	// skipped rows, so they are not mistaken for missing days, and warnings.
+	var station *Station
+	if values.Get("includeStation") == "true" {
+		st, err := s.lookupStation(r.Context(), q.stationNumber)
+		if err == sql.ErrNoRows {
+			httpError(w, r, "Station not found.", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		station = &st
+	}
+	var skippedMeta *skippedRows
+	if skipped.Count > 0 {
+		skippedMeta = &skipped
+	}
+	if station != nil || baselines != nil || skippedMeta != nil || len(q.warnings) > 0 {
+		writeJSON(w, r, struct {
+			Station  *Station            `json:"station,omitempty"`
+			Baseline map[string]*float64 `json:"baseline,omitempty"`
+			Skipped  *skippedRows        `json:"skipped_rows,omitempty"`
+			Warnings []string            `json:"warnings,omitempty"`
+			Data     interface{}         `json:"data"`
+		}{station, baselines, skippedMeta, q.warnings, data})
+		return
+	}
+
+	writeJSON(w, r, data)
+}
+
+// dataQuery is a validated /input/data request.
+type dataQuery struct {
+	stationNumber string
+	types         []string
+	derived       []derivedField
+	hidden        []string
+
+	// columns is the output column order, see outputColumns
+	columns []string
+
+	// selectList is the quoted column list to select
+	selectList string
+
+	ranges     []dateRange
+	minQuality string
+	format     string
+	header     []string
+	sparse     bool
+	layout     string
+	baseline   string
+
+	// resolution, when positive, is the number of points to downsample to
+	resolution int
+	downsample string
+
+	// warnings lists the problems lenient parsing let through
+	warnings []string
+}
+
+// parseDataQuery validates every /input/data parameter, returning all the
+// problems found rather than stopping at the first.
+func (s *server) parseDataQuery(values url.Values) (dataQuery, []string) {
+	var q dataQuery
+	var errs []string
+	fail := func(err error) {
+		errs = append(errs, err.Error())
+	}
+
+	q.stationNumber = values.Get("stationNumber")
+	if _, err := strconv.Atoi(q.stationNumber); err != nil {
+		errs = append(errs, "stationNumber must be an integer.")
+	}
+
+	// Resolve the types against the schema, selecting the stored columns and
+	// any inputs the derived fields need
+	if values.Get("type") == "" {
+		errs = append(errs, "Missing data types.")
+	} else {
+		q.types = strings.Split(values.Get("type"), ",")
+
+		// strict=false drops the unknown types for dashboards that would
+		// rather show what they can than nothing
+		switch values.Get("strict") {
+		case "", "true":
+		case "false":
+			var known []string
+			for _, t := range q.types {
+				if _, ok := lookupDerived(t); ok || isWeatherColumn(t) {
+					known = append(known, t)
+				} else {
+					q.warnings = append(q.warnings, "Unknown type "+strconv.Quote(t)+" was ignored.")
+				}
+			}
+			if len(known) == 0 {
+				errs = append(errs, "None of the requested types are known.")
+			}
+			q.types = known
+		default:
+			errs = append(errs, "strict must be either true or false.")
+		}
+
+		columns, derived, hidden, err := resolveTypes(q.types)
+		if err != nil {
+			fail(err)
+		}
+		if n := len(columns) - len(hidden) + len(derived); n > config.MaxTypes {
+			errs = append(errs, "At most "+strconv.Itoa(config.MaxTypes)+" types may be requested at once.")
+		}
+		q.derived, q.hidden = derived, hidden
+
+		// Wrap each column with double quotes
+		quoted := make([]string, len(columns))
+		for i := range columns {
+			quoted[i] = `"` + columns[i] + `"`
+		}
+		q.selectList = strings.Join(quoted, ",")
+	}
+
+	var err error
+	if q.ranges, err = parseDateRanges(values["dateRange"]); err != nil {
+		fail(err)
+	}
+	if q.minQuality, err = s.parseMinQuality(values.Get("minQuality")); err != nil {
+		fail(err)
+	}
+
+	dateFirst, err := parseDateFirst(values.Get("dateFirst"))
+	if err != nil {
+		fail(err)
+	}
+	q.columns = s.outputColumns(q.types, dateFirst)
+
+	// CSV and TSV output default to the column keys, which suit machine
+	// consumers
+	q.format = values.Get("format")
+	switch q.format {
+	case "", "json", "parquet", "influx":
+	case "csv", "tsv":
+		headers := values.Get("headers")
+		if headers == "" {
+			headers = "keys"
+		}
+		if q.header, err = columnHeaders(q.columns, headers); err != nil {
+			fail(err)
+		}
+	default:
+		errs = append(errs, "format must be json, csv, tsv, parquet or influx.")
+	}
+
+	// In sparse mode a key missing from a row means no data was recorded for
+	// that column, instead of the key being present with a null value
+	q.sparse = values.Get("sparse") == "true"
+
+	// layout=series returns one series per type with its unit, for charts
+	// that put each unit on its own axis
+	q.layout = values.Get("layout")
+	if q.layout != "" && q.layout != "rows" && q.layout != "series" {
+		errs = append(errs, "layout must be either rows or series.")
+	}
+
+	// baseline turns the values into departures from the mean or median of
+	// each type over the returned rows, or from a given number
+	q.baseline = values.Get("baseline")
+	if q.baseline != "" && q.baseline != "mean" && q.baseline != "median" {
+		if _, err := strconv.ParseFloat(q.baseline, 64); err != nil {
+			errs = append(errs, "baseline must be mean, median or a number.")
+		}
+	}
+	if q.baseline != "" && q.format != "" && q.format != "json" {
+		errs = append(errs, "baseline is only supported for JSON output.")
+	}
+
+	// resolution downsamples the JSON for charts: the series layout keeps the
+	// points that shape each line, while rows can only be averaged together
+	if v := values.Get("resolution"); v != "" {
+		if q.resolution, err = strconv.Atoi(v); err != nil || q.resolution < 3 {
+			errs = append(errs, "resolution must be an integer of at least 3.")
+		}
+		if q.format != "" && q.format != "json" {
+			errs = append(errs, "resolution is only supported for JSON output.")
+		}
+	}
+	q.downsample = values.Get("downsample")
+	if q.downsample == "" {
+		q.downsample = "mean"
+		if q.layout == "series" {
+			q.downsample = "lttb"
+		}
+	}
+	switch {
+	case q.downsample != "lttb" && q.downsample != "mean":
+		errs = append(errs, "downsample must be either lttb or mean.")
+	case q.downsample == "lttb" && q.layout != "series":
+		errs = append(errs, "downsample=lttb needs layout=series, as it picks different days for each type.")
+	}
+
+	// Directions may be returned as they are, but neither departures from
+	// their mean nor the means of downsampled runs make sense
+	if q.baseline != "" || (q.resolution > 0 && q.downsample == "mean") {
+		for _, t := range q.types {
+			if err := linearColumn(t); err != nil {
+				errs = append(errs, err.Error())
+				break
+			}
+		}
+	}
+	return q, errs
+}
+
+// handleValidateQuery runs the /input/data validation, plus a check that the
+// station exists, without querying any observations.
+func (s *server) handleValidateQuery(w http.ResponseWriter, r *http.Request) {
+	// Parameters may come in the query string or a form-encoded body
+	if err := r.ParseForm(); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, errs := s.parseDataQuery(r.Form)
+	if _, err := strconv.Atoi(q.stationNumber); err == nil {
+		_, err := s.lookupStation(r.Context(), q.stationNumber)
+		if err == sql.ErrNoRows {
+			errs = append(errs, "Station "+q.stationNumber+" does not exist.")
+		} else if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, r, struct {
+		Valid    bool     `json:"valid"`
+		Errors   []string `json:"errors,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+	}{len(errs) == 0, errs, q.warnings})
+}
+
+// seriesPoint is one observation of a single type.
+type seriesPoint struct {
+	Tanggal interface{} `json:"Tanggal"`
+	Value   interface{} `json:"value"`
+}
+
+// typeSeries is the observations of one type along with its unit, taken from
+// the schema.
+type typeSeries struct {
+	Type  string        `json:"type"`
+	Label string        `json:"label"`
+	Unit  string        `json:"unit"`
+	Data  []seriesPoint `json:"data"`
+}
+
+// seriesByType pivots rows into one series per type, in the requested order.
+// With sparse, the points without a value are left out.
+func seriesByType(types []string, rows []map[string]interface{}, sparse bool) []typeSeries {
+	series := []typeSeries{}
+	seen := map[string]bool{}
+	for _, t := range types {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		column, _ := lookupColumn(t)
+		ts := typeSeries{Type: t, Label: column.Label(), Unit: column.Unit, Data: []seriesPoint{}}
+		for _, row := range rows {
+			value, ok := row[t]
+			if sparse && (!ok || value == nil) {
+				continue
+			}
+			ts.Data = append(ts.Data, seriesPoint{row[dateColumn.Key], value})
+		}
+		series = append(series, ts)
+	}
+	return series
+}
+
+// newestObservation returns the latest Tanggal a station has within any of
+// the ranges, or "" when there are none.
+func (s *server) newestObservation(ctx context.Context, stationNumber string, ranges []dateRange) (string, error) {
+	newest := ""
+	for _, dr := range ranges {
+		var tanggal sql.NullString
+		err := s.db.QueryRowContext(ctx, "SELECT MAX(\"Tanggal\") FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3",
+			stationNumber, dr.Start.Format("2006-01-02"), dr.End.Format("2006-01-02")).Scan(&tanggal)
+		if err != nil {
+			return "", err
+		}
+		if tanggal.String > newest {
+			newest = tanggal.String
+		}
+	}
+	return newest, nil
+}
+
+// queryWeather returns the requested columns of a station's observations
+// within dr, one map of column name to value per row. With a positive
+// maxBytes it fails with errResponseTooLarge once the rows would serialize to
+// more than that. skipped works as for eachWeatherRow.
+func (s *server) queryWeather(ctx context.Context, dataType, stationNumber string, dr dateRange, minQuality string, skipped *skippedRows, maxBytes int) ([]map[string]interface{}, error) {
+	results := []map[string]interface{}{}
+	size := 0
+	err := s.eachWeatherRow(ctx, dataType, stationNumber, dr, minQuality, skipped, func(row map[string]interface{}) error {
+		// Give up as soon as the rows alone would make too large a response,
+		// before holding all of them in memory
+		size += estimateRowBytes(row)
+		if maxBytes > 0 && size > maxBytes {
+			return errResponseTooLarge
+		}
+		results = append(results, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// estimateRowBytes approximates the size of a row serialized as JSON; it
+// need not be exact, only cheap.
+func estimateRowBytes(row map[string]interface{}) int {
+	size := 2
+	for key, value := range row {
+		size += len(key) + 4
+		switch v := value.(type) {
+		case string:
+			size += len(v) + 2
+		case nil:
+			size += 4
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// skippedRowSamples is how many scan errors skippedRows keeps.
+const skippedRowSamples = 5
+
+// skippedRows counts the rows that could not be scanned, with the first few
+// errors as samples.
+type skippedRows struct {
+	Count   int      `json:"count"`
+	Samples []string `json:"samples"`
+}
+
+func (s *skippedRows) add(err error) {
+	s.Count++
+	if len(s.Samples) < skippedRowSamples {
+		s.Samples = append(s.Samples, err.Error())
+	}
+}
+
+// eachWeatherRow streams a station's observations within dr in date order,
+// calling fn with a map of column name to value for each row. On databases
+// with a qc_flag column each row carries it too, and a non-empty minQuality
+// skips the readings flagged below it. A row that fails to scan is recorded
+// in skipped and passed over, or with a nil skipped fails the whole query.
+func (s *server) eachWeatherRow(ctx context.Context, dataType, stationNumber string, dr dateRange, minQuality string, skipped *skippedRows, fn func(map[string]interface{}) error) error {
+	// Construct the SQL query based on the query parameters. Tanggal holds
+	// YYYY-MM-DD text, which sorts chronologically, so the range is compared on
+	// the raw column and the (station_number, "Tanggal") index stays usable.
+	args := []interface{}{stationNumber, dr.Start.Format("2006-01-02"), dr.End.Format("2006-01-02")}
+	if s.qcFlag {
+		// The flag's column type varies between databases, so it is read as a
+		// plain number
+		dataType += ",CAST(qc_flag AS double precision) AS qc_flag"
+	}
+	query := "SELECT " + dataType + ",\"Tanggal\" FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3"
+	if minQuality != "" {
+		// Readings that were never flagged are kept
+		query += " AND (qc_flag IS NULL OR qc_flag >= $4)"
+		args = append(args, minQuality)
+	}
+	query += " ORDER BY \"Tanggal\""
+
+	// Execute the query
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return scanWeatherRows(rows, skipped, fn)
+}
+
+// scanWeatherRows hands each of rows to fn as a map of column name to value,
+// recording rows that fail to scan in skipped as eachWeatherRow does, and
+// closes rows.
+func scanWeatherRows(rows *sql.Rows, skipped *skippedRows, fn func(map[string]interface{}) error) error {
+	defer rows.Close()
+
+	// for each database row / record, a map with the column names and row values is handed to fn
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err := rows.Scan(pointers...)
+		if err != nil && skipped != nil {
+			skipped.add(err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resultMap := make(map[string]interface{})
+		for i, val := range values {
+			// The driver hands some types over as raw text, which would
+			// serialize as base64; numbers become numbers again
+			if b, ok := val.([]byte); ok {
+				if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+					val = f
+				} else {
+					val = string(b)
+				}
+			}
+			resultMap[columns[i]] = val
+		}
+		if err := fn(resultMap); err != nil {
+			return err
+		}
+	}
+
+	// Check for any errors during iteration
+	return rows.Err()
+}
+
+// applyBaseline replaces each value of the given types with its departure
+// from a baseline: the mean or median of the type's non-NULL values across
+// rows, or a fixed number. It returns the baseline of every type, nil for
+// types without any values; categorical fields are left alone.
+func applyBaseline(rows []map[string]interface{}, types []string, baseline string) map[string]*float64 {
+	baselines := map[string]*float64{}
+	for _, t := range types {
+		if _, done := baselines[t]; done || isCategorical(t) {
+			continue
+		}
+
+		var observed []float64
+		for _, row := range rows {
+			if v, ok := toFloat(row[t]); ok {
+				observed = append(observed, v)
+			}
+		}
+
+		var b float64
+		switch baseline {
+		case "mean":
+			if len(observed) == 0 {
+				baselines[t] = nil
+				continue
+			}
+			for _, v := range observed {
+				b += v
+			}
+			b /= float64(len(observed))
+		case "median":
+			if len(observed) == 0 {
+				baselines[t] = nil
+				continue
+			}
+			sort.Float64s(observed)
+			mid := len(observed) / 2
+			b = observed[mid]
+			if len(observed)%2 == 0 {
+				b = (observed[mid-1] + observed[mid]) / 2
+			}
+		default:
+			b, _ = strconv.ParseFloat(baseline, 64)
+		}
+		baselines[t] = &b
+
+		for _, row := range rows {
+			if v, ok := toFloat(row[t]); ok {
+				row[t] = v - b
+			}
+		}
+	}
+	return baselines
+}
+
+// parseDateFirst reads the dateFirst parameter, which defaults to true.
+func parseDateFirst(v string) (bool, error) {
+	switch v {
+	case "", "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.New("dateFirst must be either true or false.")
+}
+
+// outputColumns is the column order of tabular output: the types exactly as
+// requested, each once, followed by the quality flag where the database has
+// one, with Tanggal leading or, unless dateFirst, trailing.
+func (s *server) outputColumns(types []string, dateFirst bool) []string {
+	columns := []string{}
+	if dateFirst {
+		columns = append(columns, dateColumn.Key)
+	}
+	seen := map[string]bool{}
+	for _, t := range append(types[:len(types):len(types)], s.qualityColumns()...) {
+		if !seen[t] {
+			seen[t] = true
+			columns = append(columns, t)
+		}
+	}
+	if !dateFirst {
+		columns = append(columns, dateColumn.Key)
+	}
+	return columns
+}
+
+// orderedRow serializes a row as a JSON object with its keys in the order of
+// columns rather than sorted, as maps are. Columns missing from the row, as
+// in sparse mode, are left out.
+type orderedRow struct {
+	columns []string
+	values  map[string]interface{}
+}
+
+func (o orderedRow) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for _, col := range o.columns {
+		value, ok := o.values[col]
+		if !ok {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(col)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(encoded)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// orderRows pairs each row with the column order it is serialized in.
+func orderRows(rows []map[string]interface{}, columns []string) []orderedRow {
+	ordered := make([]orderedRow, len(rows))
+	for i, row := range rows {
+		ordered[i] = orderedRow{columns, row}
+	}
+	return ordered
+}
+
+// dropNulls removes the NULL-valued columns from each row.
+func dropNulls(rows []map[string]interface{}) {
+	for _, row := range rows {
+		for column, value := range row {
+			if value == nil {
+				delete(row, column)
+			}
+		}
+	}
+}
+
+// handleAnomalyVsNormal compares a period's average against the average of the
+// same calendar days in every other year on record.
+func (s *server) handleAnomalyVsNormal(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+	if err := linearColumn(dataType); err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Match the same calendar days by their MM-DD suffix. A range that wraps
+	// past the new year matches both ends, and a range of a year or more
+	// covers every calendar day.
+	startDay, endDay := startDate.Format("01-02"), endDate.Format("01-02")
+	if endDate.Sub(startDate) >= 365*24*time.Hour {
+		startDay, endDay = "01-01", "12-31"
+	}
+	calendarDays := "SUBSTRING(\"Tanggal\", 6, 5) BETWEEN $4 AND $5"
+	if startDay > endDay {
+		calendarDays = "(SUBSTRING(\"Tanggal\", 6, 5) >= $4 OR SUBSTRING(\"Tanggal\", 6, 5) <= $5)"
+	}
+
+	var result struct {
+		StationNumber string   `json:"station_number"`
+		Type          string   `json:"type"`
+		StartDate     string   `json:"start_date"`
+		EndDate       string   `json:"end_date"`
+		PeriodMean    *float64 `json:"period_mean"`
+		PeriodCount   int      `json:"period_count"`
+		NormalMean    *float64 `json:"normal_mean"`
+		NormalCount   int      `json:"normal_count"`
+		NormalYears   int      `json:"normal_years"`
+		Anomaly       *float64 `json:"anomaly"`
+	}
+	result.StationNumber = stationNumber
+	result.Type = dataType
+	result.StartDate = startDate.Format("2006-01-02")
+	result.EndDate = endDate.Format("2006-01-02")
+
+	// Average over the requested period
+	var periodMean sql.NullFloat64
+	err = s.db.QueryRowContext(r.Context(), "SELECT AVG(\""+dataType+"\"), COUNT(\""+dataType+"\") FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3",
+		stationNumber, result.StartDate, result.EndDate).Scan(&periodMean, &result.PeriodCount)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Average over the same calendar days outside the requested period
+	var normalMean sql.NullFloat64
+	err = s.db.QueryRowContext(r.Context(), "SELECT AVG(\""+dataType+"\"), COUNT(\""+dataType+"\"), COUNT(DISTINCT CASE WHEN \""+dataType+"\" IS NOT NULL THEN SUBSTRING(\"Tanggal\", 1, 4) END) FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" NOT BETWEEN $2 AND $3 AND "+calendarDays,
+		stationNumber, result.StartDate, result.EndDate, startDay, endDay).Scan(&normalMean, &result.NormalCount, &result.NormalYears)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if periodMean.Valid {
+		result.PeriodMean = &periodMean.Float64
+	}
+	if normalMean.Valid {
+		result.NormalMean = &normalMean.Float64
+	}
+	if periodMean.Valid && normalMean.Valid {
+		anomaly := periodMean.Float64 - normalMean.Float64
+		result.Anomaly = &anomaly
+	}
+
+	writeJSON(w, r, result)
+}
+
+// rainCategory is a daily rainfall intensity class covering rr >= Min mm.
+type rainCategory struct {
+	Category string  `json:"category"`
+	Min      float64 `json:"min_mm"`
+}
+
+// rainCategories returns the BMKG daily rainfall classes, open at the top.
+// thresholds, from RAIN_CATEGORY_THRESHOLDS, overrides the lower bounds of
+// light, moderate, heavy, very heavy and extreme rain as five ascending
+// comma-separated mm values; days below the first are classed as no rain.
+func rainCategories(thresholds string) ([]rainCategory, error) {
+	categories := []rainCategory{
+		{"none", 0},
+		{"light", 0.5},
+		{"moderate", 20},
+		{"heavy", 50},
+		{"very_heavy", 100},
+		{"extreme", 150},
+	}
+
+	if thresholds != "" {
+		parts := strings.Split(thresholds, ",")
+		if len(parts) != len(categories)-1 {
+			return nil, errors.New("RAIN_CATEGORY_THRESHOLDS must list " + strconv.Itoa(len(categories)-1) + " thresholds")
+		}
+		for i, part := range parts {
+			min, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || min <= categories[i].Min {
+				return nil, errors.New("RAIN_CATEGORY_THRESHOLDS must be ascending positive numbers")
+			}
+			categories[i+1].Min = min
+		}
+	}
+	return categories, nil
+}
+
+// handleRainCategories classifies each day's rainfall into intensity classes
+// and returns the per-day classification with a histogram of days per class.
+// Days without an rr reading are excluded and only counted.
+func (s *server) handleRainCategories(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	categories := config.RainCategories
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", rr FROM \"Weather\" WHERE station_number = $1 AND \"Tanggal\" BETWEEN $2 AND $3 ORDER BY \"Tanggal\"",
+		stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	type classifiedDay struct {
+		Date     string  `json:"date"`
+		RR       float64 `json:"rr"`
+		Category string  `json:"category"`
+	}
+	type categoryCount struct {
+		rainCategory
+		Days int `json:"days"`
+	}
+	histogram := make([]categoryCount, len(categories))
+	for i, c := range categories {
+		histogram[i].rainCategory = c
+	}
+	days := []classifiedDay{}
+	excluded := 0
+	for rows.Next() {
+		var tanggal string
+		var rr sql.NullFloat64
+		if err := rows.Scan(&tanggal, &rr); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !rr.Valid {
+			excluded++
+			continue
+		}
+
+		// The class is the highest one whose lower bound the day reaches
+		class := 0
+		for i, c := range categories {
+			if rr.Float64 >= c.Min {
+				class = i
+			}
+		}
+		histogram[class].Days++
+		days = append(days, classifiedDay{tanggal, rr.Float64, categories[class].Category})
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string          `json:"station_number"`
+		StartDate     string          `json:"start_date"`
+		EndDate       string          `json:"end_date"`
+		Histogram     []categoryCount `json:"histogram"`
+		Days          []classifiedDay `json:"days"`
+		ExcludedDays  int             `json:"excluded_days"`
+	}{stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), histogram, days, excluded})
+}
+
+// recordEvent is a day that set a new all-time record, with the record it
+// broke. The first reading on file opens the timeline without a previous one.
+type recordEvent struct {
+	Date         string   `json:"date"`
+	Value        float64  `json:"value"`
+	PreviousDate *string  `json:"previous_date"`
+	Previous     *float64 `json:"previous_value"`
+}
+
+// handleRecordsTimeline walks a station's full history of a column in date
+// order and returns every day that set a new all-time high, or with
+// extreme=min a new low. A record has to beat the previous one, equalling it
+// does not count. NULL readings are skipped.
+func (s *server) handleRecordsTimeline(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+	dataType := values.Get("type")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	if !isWeatherColumn(dataType) {
+		httpError(w, r, "Invalid request. Unknown type "+strconv.Quote(dataType)+".", http.StatusBadRequest)
+		return
+	}
+
+	extreme := values.Get("extreme")
+	if extreme == "" {
+		extreme = "max"
+	}
+	if extreme != "max" && extreme != "min" {
+		httpError(w, r, "Invalid request. extreme must be either max or min.", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", \""+dataType+"\" FROM \"Weather\" WHERE station_number = $1 AND \""+dataType+"\" IS NOT NULL ORDER BY \"Tanggal\"",
+		stationNumber)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	records := []recordEvent{}
+	for rows.Next() {
+		var tanggal string
+		var value float64
+		if err := rows.Scan(&tanggal, &value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		if len(records) == 0 {
+			records = append(records, recordEvent{Date: tanggal, Value: value})
+			continue
+		}
+		last := records[len(records)-1]
+		if (extreme == "max" && value > last.Value) || (extreme == "min" && value < last.Value) {
+			records = append(records, recordEvent{Date: tanggal, Value: value, PreviousDate: &last.Date, Previous: &last.Value})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string        `json:"station_number"`
+		Type          string        `json:"type"`
+		Extreme       string        `json:"extreme"`
+		Records       []recordEvent `json:"records"`
+	}{stationNumber, dataType, extreme, records})
+}
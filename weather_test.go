@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateRange(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, stationTZ)
+	}
+	tests := []struct {
+		name       string
+		dateRange  string
+		start, end time.Time
+		wantErr    bool
+	}{
+		{name: "iso dates", dateRange: "2023-01-01,2023-01-31", start: day(2023, 1, 1), end: day(2023, 1, 31)},
+		{name: "spaces around dates", dateRange: " 2023-01-01 , 2023-01-31 ", start: day(2023, 1, 1), end: day(2023, 1, 31)},
+		{name: "single day", dateRange: "2023-02-28,2023-02-28", start: day(2023, 2, 28), end: day(2023, 2, 28)},
+		{name: "mixed layouts", dateRange: "2023/01/01,31-01-2023", start: day(2023, 1, 1), end: day(2023, 1, 31)},
+		{name: "empty string", dateRange: "", wantErr: true},
+		{name: "missing comma", dateRange: "2023-01-01 2023-01-31", wantErr: true},
+		{name: "single date", dateRange: "2023-01-01", wantErr: true},
+		{name: "extra comma", dateRange: "2023-01-01,2023-01-15,2023-01-31", wantErr: true},
+		{name: "trailing comma", dateRange: "2023-01-01,2023-01-31,", wantErr: true},
+		{name: "empty start", dateRange: ",2023-01-31", wantErr: true},
+		{name: "empty end", dateRange: "2023-01-01,", wantErr: true},
+		{name: "invalid date", dateRange: "2023-02-30,2023-03-01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := parseDateRange(tt.dateRange)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDateRange(%q) = %v, %v, want an error", tt.dateRange, start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDateRange(%q): %v", tt.dateRange, err)
+			}
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("parseDateRange(%q) = %v, %v, want %v, %v", tt.dateRange, start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// windInterval is the vector mean wind of one interval. Direction is where
+// the wind blows from, in degrees clockwise from north.
+type windInterval struct {
+	Period    string   `json:"period"`
+	Direction *float64 `json:"direction"`
+	Speed     float64  `json:"speed"`
+	MeanSpeed float64  `json:"mean_speed"`
+	Constancy *float64 `json:"constancy"`
+	Days      int      `json:"days"`
+	dataCoverage
+
+	u, v float64
+}
+
+// handleWind averages wind per interval as vectors. Each day's speed and
+// ddd_x direction are decomposed into u (eastward) and v (northward)
+// components, which are averaged and recomposed, so 350° and 10° average to
+// 0° rather than 180°. speed selects the speed column, ff_x by default,
+// whose direction ddd_x records, or ff_avg. Also returned are the scalar mean
+// speed and the constancy, the ratio of vector to scalar mean speed. where
+// restricts the days averaged, e.g. the wind on rainy days with where=rr>1.
+func (s *server) handleWind(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	stationNumber := values.Get("stationNumber")
+
+	if _, err := strconv.Atoi(stationNumber); err != nil {
+		httpError(w, r, "Invalid request. stationNumber must be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	startDate, endDate, err := parseDateRange(values.Get("dateRange"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, err := parseWhere(values.Get("where"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	interval, err := parseInterval(values.Get("interval"))
+	if err != nil {
+		httpError(w, r, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	speedColumn := values.Get("speed")
+	if speedColumn == "" {
+		speedColumn = "ff_x"
+	}
+	if speedColumn != "ff_x" && speedColumn != "ff_avg" {
+		httpError(w, r, "Invalid request. speed must be either ff_x or ff_avg.", http.StatusBadRequest)
+		return
+	}
+
+	cond, args := where.sql([]interface{}{stationNumber, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")})
+	rows, err := s.db.QueryContext(r.Context(), "SELECT \"Tanggal\", "+speedColumn+", ddd_x FROM \"Weather\" WHERE station_number = $1 AND "+speedColumn+" IS NOT NULL AND ddd_x IS NOT NULL AND \"Tanggal\" BETWEEN $2 AND $3"+cond+" ORDER BY \"Tanggal\"",
+		args...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	intervals := []*windInterval{}
+	for rows.Next() {
+		var tanggal string
+		var speed, direction float64
+		if err := rows.Scan(&tanggal, &speed, &direction); err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		// Rows are ordered by date, so intervals arrive in order too
+		key := intervalKey(tanggal, interval)
+		if len(intervals) == 0 || intervals[len(intervals)-1].Period != key {
+			intervals = append(intervals, &windInterval{Period: key})
+		}
+		current := intervals[len(intervals)-1]
+
+		// The wind blows from direction, so its vector points the other way
+		theta := direction * math.Pi / 180
+		current.u += -speed * math.Sin(theta)
+		current.v += -speed * math.Cos(theta)
+		current.MeanSpeed += speed
+		current.Days++
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	for _, iv := range intervals {
+		n := float64(iv.Days)
+		u, v := iv.u/n, iv.v/n
+		iv.Speed = math.Hypot(u, v)
+		iv.dataCoverage = newDataCoverage(iv.Days, periodDays(iv.Period, interval, startDate, endDate))
+		iv.MeanSpeed /= n
+
+		// Calm or perfectly opposed winds have no resultant direction
+		if iv.Speed > 1e-9 {
+			direction := math.Mod(math.Atan2(-u, -v)*180/math.Pi+360, 360)
+			iv.Direction = &direction
+		}
+		if iv.MeanSpeed > 0 {
+			constancy := iv.Speed / iv.MeanSpeed
+			iv.Constancy = &constancy
+		}
+	}
+
+	writeJSON(w, r, struct {
+		StationNumber string          `json:"station_number"`
+		Interval      string          `json:"interval"`
+		SpeedColumn   string          `json:"speed_column"`
+		Intervals     []*windInterval `json:"intervals"`
+	}{stationNumber, interval, speedColumn, intervals})
+}